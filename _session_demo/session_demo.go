@@ -16,6 +16,9 @@ import (
 
 var templ = template.Must(template.New("").Parse(page))
 
+// countKey is the typed key of the visit counter attribute.
+var countKey = session.NewKey("Count", 0)
+
 // myHandler handles everything: page/form rendering, processing login form submits, logout submits.
 // If login is successful, a new session is created. If logout is successful, session is removed.
 func myHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,7 +31,7 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 			session.Remove(sess, w) // Logout user
 			sess = nil
 		} else {
-			sess.SetAttr("Count", sess.Attr("Count").(int)+1)
+			countKey.Set(sess, countKey.Get(sess)+1)
 		}
 	} else {
 		// Not logged in
@@ -37,7 +40,7 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 				// Successful login. New session with initial constant and variable attributes:
 				sess = session.NewSessionOptions(&session.SessOptions{
 					CAttrs: map[string]interface{}{"UserName": userName},
-					Attrs:  map[string]interface{}{"Count": 1},
+					Attrs:  map[string]interface{}{countKey.Name(): 1},
 				})
 				session.Add(sess, w)
 			} else {
@@ -48,7 +51,7 @@ func myHandler(w http.ResponseWriter, r *http.Request) {
 
 	if sess != nil {
 		m["UserName"] = sess.CAttr("UserName")
-		m["Count"] = sess.Attr("Count")
+		m["Count"] = countKey.Get(sess)
 	}
 
 	if err := templ.Execute(w, m); err != nil {
@@ -0,0 +1,99 @@
+/*
+
+Generic, type-safe attribute accessors built on top of the Session interface.
+
+*/
+
+package session
+
+// GetAttr returns the value of the attribute stored in the session, asserted to type T.
+// ok is false if the attribute does not exist or its value is not of type T
+// (in which case the zero value of T is returned).
+func GetAttr[T any](sess Session, name string) (value T, ok bool) {
+	value, ok = sess.Attr(name).(T)
+	return
+}
+
+// GetCAttr returns the value of the constant attribute provided at session creation, asserted to type T.
+// ok is false if the attribute does not exist or its value is not of type T
+// (in which case the zero value of T is returned).
+func GetCAttr[T any](sess Session, name string) (value T, ok bool) {
+	value, ok = sess.CAttr(name).(T)
+	return
+}
+
+// Key is a typed attribute key which carries the attribute's default value.
+// It is safe to use Key values from multiple goroutines, and it is
+// recommended to declare them as package level variables, e.g.
+//
+//	var countKey = session.NewKey("Count", 0)
+//
+//	count := countKey.Get(sess) // count is of type int
+//	countKey.Set(sess, count+1)
+type Key[T any] struct {
+	name string // Name of the attribute
+	def  T      // Default value of the attribute
+}
+
+// NewKey creates a new typed attribute key with the given name and default value.
+func NewKey[T any](name string, def T) Key[T] {
+	return Key[T]{name: name, def: def}
+}
+
+// Name returns the name of the attribute.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Default returns the default value of the attribute.
+func (k Key[T]) Default() T {
+	return k.def
+}
+
+// Get returns the value of the attribute stored in the session,
+// or the default value if the attribute does not exist or it is not of type T.
+func (k Key[T]) Get(sess Session) T {
+	if v, ok := GetAttr[T](sess, k.name); ok {
+		return v
+	}
+	return k.def
+}
+
+// Lookup returns the value of the attribute stored in the session.
+// ok is false if the attribute does not exist or it is not of type T,
+// in which case the default value is returned.
+func (k Key[T]) Lookup(sess Session) (value T, ok bool) {
+	if value, ok = GetAttr[T](sess, k.name); !ok {
+		value = k.def
+	}
+	return
+}
+
+// Set sets the value of the attribute stored in the session.
+func (k Key[T]) Set(sess Session, value T) {
+	sess.SetAttr(k.name, value)
+}
+
+// Delete deletes the attribute from the session.
+func (k Key[T]) Delete(sess Session) {
+	sess.SetAttr(k.name, nil)
+}
+
+// CGet returns the value of the constant attribute provided at session creation,
+// or the default value if the attribute does not exist or it is not of type T.
+func (k Key[T]) CGet(sess Session) T {
+	if v, ok := GetCAttr[T](sess, k.name); ok {
+		return v
+	}
+	return k.def
+}
+
+// CLookup returns the value of the constant attribute provided at session creation.
+// ok is false if the attribute does not exist or it is not of type T,
+// in which case the default value is returned.
+func (k Key[T]) CLookup(sess Session) (value T, ok bool) {
+	if value, ok = GetCAttr[T](sess, k.name); !ok {
+		value = k.def
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestGetAttr(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{
+		CAttrs: map[string]interface{}{"user": "bob"},
+		Attrs:  map[string]interface{}{"count": 3},
+	})
+
+	count, ok := GetAttr[int](s, "count")
+	eq(3, count)
+	eq(true, ok)
+
+	str, ok := GetAttr[string](s, "count")
+	eq("", str)
+	eq(false, ok)
+
+	count, ok = GetAttr[int](s, "missing")
+	eq(0, count)
+	eq(false, ok)
+
+	user, ok := GetCAttr[string](s, "user")
+	eq("bob", user)
+	eq(true, ok)
+
+	_, ok = GetCAttr[int](s, "user")
+	eq(false, ok)
+}
+
+func TestKey(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	countKey := NewKey("count", 10)
+	eq("count", countKey.Name())
+	eq(10, countKey.Default())
+
+	s := NewSession()
+	eq(10, countKey.Get(s))
+	v, ok := countKey.Lookup(s)
+	eq(10, v)
+	eq(false, ok)
+
+	countKey.Set(s, 11)
+	eq(11, countKey.Get(s))
+	eq(11, s.Attr("count"))
+	v, ok = countKey.Lookup(s)
+	eq(11, v)
+	eq(true, ok)
+
+	// Value of different type:
+	s.SetAttr("count", "x")
+	eq(10, countKey.Get(s))
+
+	countKey.Delete(s)
+	eq(nil, s.Attr("count"))
+
+	userKey := NewKey("user", "guest")
+	eq("guest", userKey.CGet(s))
+	s = NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"user": "bob"}})
+	eq("bob", userKey.CGet(s))
+	u, ok := userKey.CLookup(s)
+	eq("bob", u)
+	eq(true, ok)
+}
@@ -0,0 +1,365 @@
+/*
+
+A stateless session Manager implementation which stores whole sessions in encrypted cookies.
+
+*/
+
+package session
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ErrCookieTooLarge is returned when a session does not fit into a cookie.
+var ErrCookieTooLarge = errors.New("session: cookie too large")
+
+// ClientCookieManager is a stateless session Manager implementation:
+// it has no backing Store, whole sessions (ID, times, constant and variable attributes, timeout)
+// are stored at the clients in cookies, encrypted and authenticated using AES-GCM.
+// ClientCookieManager also implements ManagerCtx.
+//
+// Since sessions are not stored at the server side, changes made to a session (e.g. Session.SetAttr())
+// and its last accessed time are only persisted when the session is added again to the HTTP response
+// (Manager.Add()), before the response headers are written. For the same reason, removing a session
+// only asks the client to delete the cookie, a copy of the cookie remains valid until the session expires.
+type ClientCookieManager struct {
+	aeads []cipher.AEAD // AEADs of the keys, first is the current one
+
+	cookieName      string // Name of the cookie used for storing the session
+	cookieSecure    bool   // Tells if session cookies are to be sent only over HTTPS
+	cookieMaxAgeSec int    // Max age for session cookies in seconds
+	cookiePath      string // Cookie path to use
+	maxCookieSize   int    // Max size of session cookies
+
+	codec     Codec           // Codec to encode sessions with
+	logger    *sessLogger     // Logger of session lifecycle events and errors
+	listeners *eventListeners // Listeners to notify about session lifecycle events
+}
+
+// ClientCookieMngrOptions defines options that may be passed when creating a new ClientCookieManager.
+// All fields are optional; default value will be used for any field that has the zero value.
+type ClientCookieMngrOptions struct {
+	// Name of the cookie used for storing the session; default value is "sess"
+	CookieName string
+
+	// Tells if session cookies are allowed to be sent over unsecure HTTP too (else only HTTPS);
+	// default value is false (only HTTPS)
+	AllowHTTP bool
+
+	// Max age for session cookies; default value is 30 days.
+	// Max age is capped to the remaining lifetime of sessions having a max lifetime.
+	CookieMaxAge time.Duration
+
+	// Cookie path to use; default value is the root: "/"
+	CookiePath string
+
+	// Max size of session cookies (name, value and attributes); default value is 4096 bytes,
+	// the limit of most browsers. Sessions not fitting into a cookie cannot be added.
+	MaxCookieSize int
+
+	// Codec to encode sessions with, default is GobCodec.
+	// Sessions encoded with other registered codecs (see RegisterCodec()) can also be decoded,
+	// so the codec may be changed without losing existing sessions.
+	Codec Codec
+
+	// Logger to log errors of Manager operations (ManagerCtx operations report errors).
+	// Default is to use the global functions of the log package.
+	// To disable logging, you may use NoopLogger.
+	Logger *log.Logger
+
+	// Handler to emit structured log records of session lifecycle events and errors with (see LogEvent),
+	// default is none. If set, Logger is not used.
+	// Since sessions are stored at the clients, expired sessions are only logged
+	// when a client sends the cookie of one.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// Since sessions are stored at the clients, expired sessions are only reported
+	// when a client sends the cookie of one.
+	Listeners []EventListener
+}
+
+// Pointer to zero value of ClientCookieMngrOptions to be reused for efficiency.
+var zeroClientCookieMngrOptions = new(ClientCookieMngrOptions)
+
+// NewClientCookieManager creates a new, stateless, encrypted cookie based session Manager with default options.
+// Default values of options are listed in the ClientCookieMngrOptions type.
+// See NewClientCookieManagerOptions() for details.
+func NewClientCookieManager(keys [][]byte) (Manager, error) {
+	return NewClientCookieManagerOptions(keys, zeroClientCookieMngrOptions)
+}
+
+// NewClientCookieManagerOptions creates a new, stateless, encrypted cookie based session Manager
+// with the specified options.
+//
+// keys are AES keys (16, 24 or 32 bytes long), at least one is required.
+// The first key is the current one, used to encrypt new cookies; all keys are used to decrypt cookies,
+// so to rotate keys, prepend a new key and keep the previous ones until their cookies expire.
+//
+// Only sessions created by this package (NewSession() and NewSessionOptions()) can be managed.
+// Sessions are encoded using the codec specified in the options (GobCodec by default),
+// types of attribute values must be registered with the codec (e.g. gob.Register() for GobCodec).
+func NewClientCookieManagerOptions(keys [][]byte, o *ClientCookieMngrOptions) (Manager, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: no keys provided")
+	}
+
+	m := &ClientCookieManager{
+		cookieName:    o.CookieName,
+		cookieSecure:  !o.AllowHTTP,
+		cookiePath:    o.CookiePath,
+		maxCookieSize: o.MaxCookieSize,
+		logger:        newSessLogger(o.Logger, o.LogHandler, o.LogLevels),
+		codec:         o.Codec,
+		listeners:     newEventListeners(o.Listeners),
+	}
+	m.logger.textErrorsOnly = true // Logger is documented to log errors only
+
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("session: invalid key #%d: %w", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		m.aeads = append(m.aeads, aead)
+	}
+
+	if m.cookieName == "" {
+		m.cookieName = "sess"
+	}
+	if o.CookieMaxAge == 0 {
+		m.cookieMaxAgeSec = 30 * 24 * 60 * 60 // 30 days max age
+	} else {
+		m.cookieMaxAgeSec = int(o.CookieMaxAge.Seconds())
+	}
+	if m.cookiePath == "" {
+		m.cookiePath = "/"
+	}
+	if m.maxCookieSize == 0 {
+		m.maxCookieSize = 4096
+	}
+	if m.codec == nil {
+		m.codec = GobCodec{}
+	}
+
+	return m, nil
+}
+
+// Get is to implement Manager.Get().
+func (m *ClientCookieManager) Get(r *http.Request) Session {
+	sess, err := m.GetCtx(r)
+	if err != nil {
+		m.logger.error("Failed to get session", err)
+		return nil
+	}
+	return sess
+}
+
+// Add is to implement Manager.Add().
+func (m *ClientCookieManager) Add(sess Session, w http.ResponseWriter) {
+	if err := m.AddCtx(context.Background(), sess, w); err != nil {
+		m.logger.error("Failed to add session", err, sess.ID())
+	}
+}
+
+// Remove is to implement Manager.Remove().
+func (m *ClientCookieManager) Remove(sess Session, w http.ResponseWriter) {
+	m.RemoveCtx(context.Background(), sess, w)
+}
+
+// Regenerate is to implement Manager.Regenerate().
+// Since there is no server side state, the old session cannot be invalidated,
+// copies of its cookie remain valid until the session expires.
+func (m *ClientCookieManager) Regenerate(sess Session, w http.ResponseWriter) Session {
+	sess2, err := m.RegenerateCtx(context.Background(), sess, w)
+	if err != nil {
+		m.logger.error("Failed to regenerate session", err, sess.ID())
+		return nil
+	}
+	return sess2
+}
+
+// GetCtx is to implement ManagerCtx.GetCtx().
+// Cookies that cannot be decrypted (e.g. tampered, or encrypted with a dropped key) are treated
+// as if there were no session cookies.
+func (m *ClientCookieManager) GetCtx(r *http.Request) (Session, error) {
+	c, err := r.Cookie(m.cookieName)
+	if err != nil {
+		return nil, nil
+	}
+
+	data, ok := m.decrypt(c.Value)
+	if !ok {
+		m.logger.rejected("invalid_cookie")
+		return nil, nil
+	}
+	sess, err := decodeSession(data, m.codec)
+	if err != nil {
+		return nil, err
+	}
+	if expired(sess, time.Now()) {
+		m.logger.expired(sess.ID(), sess)
+		m.listeners.expired(sess)
+		return nil, nil
+	}
+
+	sess.Access()
+	m.logger.accessed(sess)
+	m.listeners.accessed(sess)
+	return sess, nil
+}
+
+// AddCtx is to implement ManagerCtx.AddCtx().
+// ErrCookieTooLarge is returned if the session does not fit into a cookie.
+func (m *ClientCookieManager) AddCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	if err := m.setCookie(sess, w); err != nil {
+		return err
+	}
+	m.logger.added(sess)
+	m.listeners.added(sess)
+	return nil
+}
+
+// setCookie sets the cookie holding the encrypted session in the HTTP response.
+func (m *ClientCookieManager) setCookie(sess Session, w http.ResponseWriter) error {
+	data, err := MarshalSession(sess, m.codec)
+	if err != nil {
+		return err
+	}
+
+	value, err := m.encrypt(data)
+	if err != nil {
+		return err
+	}
+
+	c := http.Cookie{
+		Name:     m.cookieName,
+		Value:    value,
+		Path:     m.cookiePath,
+		HttpOnly: true,
+		Secure:   m.cookieSecure,
+		MaxAge:   m.cookieMaxAgeSec,
+	}
+	capCookieMaxAge(&c, sess)
+
+	if len(c.String()) > m.maxCookieSize {
+		return ErrCookieTooLarge
+	}
+
+	http.SetCookie(w, &c)
+	return nil
+}
+
+// RemoveCtx is to implement ManagerCtx.RemoveCtx().
+// It never fails.
+func (m *ClientCookieManager) RemoveCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	// Set the cookie with empty value and 0 max age
+	c := http.Cookie{
+		Name:     m.cookieName,
+		Value:    "",
+		Path:     m.cookiePath,
+		HttpOnly: true,
+		Secure:   m.cookieSecure,
+		MaxAge:   -1, // MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
+	}
+	http.SetCookie(w, &c)
+	m.logger.removed(sess)
+	m.listeners.removed(sess)
+	return nil
+}
+
+// RegenerateCtx is to implement ManagerCtx.RegenerateCtx().
+// See Regenerate() for limitations.
+func (m *ClientCookieManager) RegenerateCtx(ctx context.Context, sess Session, w http.ResponseWriter) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.setCookie(sess2, w); err != nil {
+		return nil, err
+	}
+	m.logger.regenerated(sess, sess2)
+	m.listeners.removed(sess)
+	m.listeners.created(sess2)
+	return sess2, nil
+}
+
+// Close is to implement Manager.Close().
+// There are no resources to release.
+func (m *ClientCookieManager) Close() {}
+
+// encrypt encrypts data with the current key, and returns it in a cookie-safe encoding.
+// The random nonce is prepended to the ciphertext, the cookie name is used as additional data.
+// An error is returned if the nonce cannot be generated: a reused nonce would expose the keystream.
+func (m *ClientCookieManager) encrypt(data []byte) (string, error) {
+	aead := m.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, data, []byte(m.cookieName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt decrypts a value produced by encrypt() trying all keys.
+// ok is false if the value cannot be decrypted.
+func (m *ClientCookieManager) decrypt(value string) (data []byte, ok bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, aead := range m.aeads {
+		ns := aead.NonceSize()
+		if len(sealed) < ns {
+			continue
+		}
+		if data, err := aead.Open(nil, sealed[:ns], sealed[ns:], []byte(m.cookieName)); err == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// CookieName returns the name of the cookie used for storing the session.
+func (m *ClientCookieManager) CookieName() string {
+	return m.cookieName
+}
+
+// CookieSecure tells if session cookies are to be sent only over HTTPS.
+func (m *ClientCookieManager) CookieSecure() bool {
+	return m.cookieSecure
+}
+
+// CookieMaxAgeSec returns the Max age for session cookies in seconds.
+func (m *ClientCookieManager) CookieMaxAgeSec() int {
+	return m.cookieMaxAgeSec
+}
+
+// CookiePath returns the used cookie path.
+func (m *ClientCookieManager) CookiePath() string {
+	return m.cookiePath
+}
+
+// MaxCookieSize returns the max size of session cookies.
+func (m *ClientCookieManager) MaxCookieSize() int {
+	return m.maxCookieSize
+}
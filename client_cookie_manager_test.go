@@ -0,0 +1,141 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func TestClientCookieManager(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	mgr, err := NewClientCookieManagerOptions([][]byte{key}, &ClientCookieMngrOptions{
+		CookieName:   "test",
+		AllowHTTP:    true,
+		CookieMaxAge: time.Second * 1234,
+		CookiePath:   "/testpath",
+	})
+	eq(nil, err)
+	defer mgr.Close()
+
+	cmgr := mgr.(*ClientCookieManager)
+	eq("test", cmgr.CookieName())
+	eq(false, cmgr.CookieSecure())
+	eq(1234, cmgr.CookieMaxAgeSec())
+	eq("/testpath", cmgr.CookiePath())
+	eq(4096, cmgr.MaxCookieSize())
+
+	eq(nil, mgr.Get(httptest.NewRequest("GET", "/", nil)))
+
+	s := NewSessionOptions(&SessOptions{
+		CAttrs: map[string]interface{}{"ca": "x"},
+		Attrs:  map[string]interface{}{"a": 1},
+	})
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+	c := w.Result().Cookies()[0]
+	eq(false, strings.Contains(c.Value, s.ID()))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	s2 := mgr.Get(r)
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	eq("x", s2.CAttr("ca"))
+	eq(1, s2.Attr("a"))
+	eq(s.Timeout(), s2.Timeout())
+
+	// Tampered cookie:
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value[:len(c.Value)-2] + "AA"})
+	eq(nil, mgr.Get(r))
+
+	w = httptest.NewRecorder()
+	mgr.Remove(s2, w)
+	eq(-1, w.Result().Cookies()[0].MaxAge)
+
+	w = httptest.NewRecorder()
+	s3 := mgr.Regenerate(s2, w)
+	neq(s2.ID(), s3.ID())
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	eq(s3.ID(), mgr.Get(r).ID())
+}
+
+func TestClientCookieManagerKeyRotation(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	k1, k2 := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	mgr1, err := NewClientCookieManager([][]byte{k1})
+	eq(nil, err)
+	mgr2, err := NewClientCookieManager([][]byte{k2, k1})
+	eq(nil, err)
+	mgr3, err := NewClientCookieManager([][]byte{k2})
+	eq(nil, err)
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr1.Add(s, w)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+
+	eq(nil, mgr3.Get(r))
+	s2 := mgr2.Get(r)
+	neq(nil, s2)
+
+	// Adding again re-encrypts with the current key:
+	w = httptest.NewRecorder()
+	mgr2.Add(s2, w)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	eq(s.ID(), mgr3.Get(r).ID())
+	eq(nil, mgr1.Get(r))
+
+	_, err = NewClientCookieManager(nil)
+	neq(nil, err)
+	_, err = NewClientCookieManager([][]byte{[]byte("short")})
+	neq(nil, err)
+}
+
+func TestClientCookieManagerLimits(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	mgr, err := NewClientCookieManagerOptions([][]byte{[]byte("0123456789abcdef")},
+		&ClientCookieMngrOptions{Logger: NoopLogger})
+	eq(nil, err)
+
+	// Too large session:
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": strings.Repeat("x", 5000)}})
+	w := httptest.NewRecorder()
+	eq(ErrCookieTooLarge, mgr.(ManagerCtx).AddCtx(context.Background(), s, w))
+	eq(0, len(w.Result().Cookies()))
+
+	// Expired session:
+	s = NewSessionOptions(&SessOptions{Timeout: 10 * time.Millisecond})
+	w = httptest.NewRecorder()
+	mgr.Add(s, w)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	eq(s.ID(), mgr.Get(r).ID())
+	time.Sleep(20 * time.Millisecond)
+	eq(nil, mgr.Get(r))
+
+	// Failing random source (no nonce):
+	s = NewSession()
+	errRand := errors.New("rand")
+	defer func(r io.Reader) { rand.Reader = r }(rand.Reader)
+	rand.Reader = iotest.ErrReader(errRand)
+	w = httptest.NewRecorder()
+	eq(errRand, mgr.(ManagerCtx).AddCtx(context.Background(), s, w))
+	eq(0, len(w.Result().Cookies()))
+}
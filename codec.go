@@ -0,0 +1,432 @@
+/*
+
+Session serialization: the Codec interface, its gob and JSON implementations,
+and the versioned envelope format of marshaled sessions.
+
+*/
+
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SessionData is the serializable state of a session, which is encoded by Codecs.
+type SessionData struct {
+	ID          string                 // ID of the session
+	Created     time.Time              // Creation time
+	Accessed    time.Time              // Last accessed time
+	Modified    time.Time              // Last modification time of the attributes
+	CAttrs      map[string]interface{} // Constant attributes
+	Attrs       map[string]interface{} // Attributes
+	Timeout     time.Duration          // Session timeout
+	MaxLifetime time.Duration          // Session max lifetime, 0 means no limit
+	Version     uint64                 // Version of the attributes
+}
+
+// Codec is the interface of session data encoders / decoders.
+// Codecs must be safe for concurrent use.
+type Codec interface {
+	// Name returns the name of the codec, which is recorded in marshaled sessions
+	// so they can be unmarshaled with the same codec.
+	Name() string
+
+	// Marshal encodes the session data.
+	Marshal(d *SessionData) ([]byte, error)
+
+	// Unmarshal decodes the session data encoded by Marshal().
+	Unmarshal(data []byte, d *SessionData) error
+}
+
+// GobCodec is a Codec using encoding/gob.
+// Concrete types of attribute values must be registered with gob.Register();
+// time.Time and time.Duration are registered by this package.
+type GobCodec struct{}
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(time.Duration(0))
+}
+
+// Name is to implement Codec.Name().
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+// Marshal is to implement Codec.Marshal().
+func (GobCodec) Marshal(d *SessionData) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal is to implement Codec.Unmarshal().
+func (GobCodec) Unmarshal(data []byte, d *SessionData) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(d)
+}
+
+// JSONCodec is a Codec using encoding/json.
+//
+// Attribute values are encoded along with the name of their type, so they can be decoded
+// into values of the same type. Types of attribute values must be registered with Register()
+// or RegisterName(); the predeclared types (e.g. int, string, float64), []byte, []string,
+// []interface{}, map[string]interface{}, time.Time and time.Duration are registered by default.
+// Note that values nested in []interface{} and map[string]interface{} values are decoded
+// as the default types of encoding/json (e.g. numbers as float64).
+//
+// Use NewJSONCodec() to create a new JSONCodec.
+type JSONCodec struct {
+	mux   sync.RWMutex            // Mutex to protect the type registry
+	types map[string]reflect.Type // Registered types, mapped from name
+	names map[reflect.Type]string // Names of registered types
+}
+
+// NewJSONCodec creates a new JSONCodec, with the default types registered.
+func NewJSONCodec() *JSONCodec {
+	c := &JSONCodec{
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+
+	for _, v := range []interface{}{
+		false, "", 0, int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0), float32(0), float64(0),
+		[]byte(nil), []string(nil), []interface{}(nil), map[string]interface{}(nil),
+		time.Time{}, time.Duration(0),
+	} {
+		c.Register(v)
+	}
+
+	return c
+}
+
+// Register registers the type of value, under the name of its type (as returned by reflect.Type.String()).
+// Register panics if the name is already registered for a different type.
+func (c *JSONCodec) Register(value interface{}) {
+	c.RegisterName(reflect.TypeOf(value).String(), value)
+}
+
+// RegisterName registers the type of value under the given name.
+// RegisterName panics if the name is already registered for a different type,
+// or the type is already registered under a different name.
+func (c *JSONCodec) RegisterName(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if t2, ok := c.types[name]; ok && t2 != t {
+		panic(fmt.Sprintf("session: registering duplicate types for %q: %s != %s", name, t2, t))
+	}
+	if n2, ok := c.names[t]; ok && n2 != name {
+		panic(fmt.Sprintf("session: registering duplicate names for %s: %q != %q", t, n2, name))
+	}
+	c.types[name] = t
+	c.names[t] = name
+}
+
+// jsonValue is the JSON form of an attribute value.
+type jsonValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v"`
+}
+
+// jsonSessionData is the JSON form of SessionData.
+type jsonSessionData struct {
+	ID          string               `json:"id"`
+	Created     time.Time            `json:"created"`
+	Accessed    time.Time            `json:"accessed"`
+	Modified    time.Time            `json:"modified"`
+	CAttrs      map[string]jsonValue `json:"cattrs,omitempty"`
+	Attrs       map[string]jsonValue `json:"attrs,omitempty"`
+	Timeout     time.Duration        `json:"timeout"`
+	MaxLifetime time.Duration        `json:"maxLifetime,omitempty"`
+	Version     uint64               `json:"version,omitempty"`
+}
+
+// Name is to implement Codec.Name().
+func (c *JSONCodec) Name() string {
+	return "json"
+}
+
+// Marshal is to implement Codec.Marshal().
+func (c *JSONCodec) Marshal(d *SessionData) ([]byte, error) {
+	jd := jsonSessionData{
+		ID:          d.ID,
+		Created:     d.Created,
+		Accessed:    d.Accessed,
+		Modified:    d.Modified,
+		Timeout:     d.Timeout,
+		MaxLifetime: d.MaxLifetime,
+		Version:     d.Version,
+	}
+
+	var err error
+	if jd.CAttrs, err = c.marshalAttrs(d.CAttrs); err != nil {
+		return nil, err
+	}
+	if jd.Attrs, err = c.marshalAttrs(d.Attrs); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&jd)
+}
+
+// marshalAttrs converts attributes to their JSON form.
+func (c *JSONCodec) marshalAttrs(attrs map[string]interface{}) (map[string]jsonValue, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	m := make(map[string]jsonValue, len(attrs))
+	for k, v := range attrs {
+		name, ok := c.names[reflect.TypeOf(v)]
+		if !ok {
+			return nil, fmt.Errorf("session: type not registered for JSON codec: %T (attribute %q)", v, k)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("session: failed to marshal attribute %q: %w", k, err)
+		}
+		m[k] = jsonValue{Type: name, Value: data}
+	}
+	return m, nil
+}
+
+// Unmarshal is to implement Codec.Unmarshal().
+func (c *JSONCodec) Unmarshal(data []byte, d *SessionData) error {
+	var jd jsonSessionData
+	if err := json.Unmarshal(data, &jd); err != nil {
+		return err
+	}
+
+	*d = SessionData{
+		ID:          jd.ID,
+		Created:     jd.Created,
+		Accessed:    jd.Accessed,
+		Modified:    jd.Modified,
+		Timeout:     jd.Timeout,
+		MaxLifetime: jd.MaxLifetime,
+		Version:     jd.Version,
+	}
+
+	var err error
+	if d.CAttrs, err = c.unmarshalAttrs(jd.CAttrs); err != nil {
+		return err
+	}
+	d.Attrs, err = c.unmarshalAttrs(jd.Attrs)
+	return err
+}
+
+// unmarshalAttrs converts attributes from their JSON form.
+func (c *JSONCodec) unmarshalAttrs(m map[string]jsonValue) (map[string]interface{}, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	attrs := make(map[string]interface{}, len(m))
+	for k, jv := range m {
+		t, ok := c.types[jv.Type]
+		if !ok {
+			return nil, fmt.Errorf("session: type not registered for JSON codec: %s (attribute %q)", jv.Type, k)
+		}
+		p := reflect.New(t)
+		if err := json.Unmarshal(jv.Value, p.Interface()); err != nil {
+			return nil, fmt.Errorf("session: failed to unmarshal attribute %q: %w", k, err)
+		}
+		attrs[k] = p.Elem().Interface()
+	}
+	return attrs, nil
+}
+
+// DefaultJSONCodec is the JSONCodec registered by default (see RegisterCodec()).
+// Types of attribute values may be registered with it.
+var DefaultJSONCodec = NewJSONCodec()
+
+// codecs is the registry of codecs, mapped from name.
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	GobCodec{}.Name():       GobCodec{},
+	DefaultJSONCodec.Name(): DefaultJSONCodec,
+}}
+
+// RegisterCodec registers a codec, replacing the codec registered with the same name.
+// UnmarshalSession() uses registered codecs to decode sessions.
+// GobCodec and DefaultJSONCodec are registered by default.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	codecs.m[c.Name()] = c
+}
+
+// lookupCodec returns the codec registered with the given name, nil if there is none.
+func lookupCodec(name string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	return codecs.m[name]
+}
+
+// Envelope format of marshaled sessions:
+//
+//	byte 0:             envelopeMagic
+//	byte 1:             version of the envelope format
+//	byte 2:             length of the codec name (n)
+//	bytes 3 .. 3+n:     codec name
+//	bytes 3+n .. :      session data encoded by the codec
+//
+// Sessions encoded directly with encoding/gob (by previous versions of this package)
+// never start with envelopeMagic, so they can still be decoded.
+const (
+	envelopeMagic   = 0x00
+	envelopeVersion = 1
+)
+
+// ErrUnknownCodec is returned by UnmarshalSession() if the codec of a marshaled session
+// is not registered.
+var ErrUnknownCodec = errors.New("session: unknown codec")
+
+// MarshalSession marshals the session using the given codec,
+// wrapped in a versioned envelope which records the codec.
+// Only sessions created by this package (NewSession() and NewSessionOptions()) can be marshaled.
+func MarshalSession(sess Session, c Codec) ([]byte, error) {
+	s, ok := toImpl(sess)
+	if !ok {
+		return nil, errUnsupportedSession
+	}
+	name := c.Name()
+	if len(name) > 255 {
+		return nil, fmt.Errorf("session: codec name too long: %q", name)
+	}
+
+	d := s.data()
+	payload, err := c.Marshal(&d)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, 3+len(name)+len(payload))
+	data = append(data, envelopeMagic, envelopeVersion, byte(len(name)))
+	data = append(data, name...)
+	return append(data, payload...), nil
+}
+
+// UnmarshalSession unmarshals a session marshaled by MarshalSession(),
+// using the registered codec recorded in the envelope.
+// The returned session is fully functional, it has its own, fresh mutex.
+func UnmarshalSession(data []byte) (Session, error) {
+	return decodeSession(data, nil)
+}
+
+// decodeSession unmarshals a session marshaled by MarshalSession().
+// If c is not nil and the envelope records its name, c is used,
+// else the registered codec recorded in the envelope.
+// Sessions encoded directly with encoding/gob (without envelope) are also decoded.
+func decodeSession(data []byte, c Codec) (Session, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		return decodeLegacySession(data)
+	}
+
+	if len(data) < 3 {
+		return nil, errors.New("session: invalid envelope")
+	}
+	if data[1] != envelopeVersion {
+		return nil, fmt.Errorf("session: unsupported envelope version: %d", data[1])
+	}
+	n := int(data[2])
+	if len(data) < 3+n {
+		return nil, errors.New("session: invalid envelope")
+	}
+	name := string(data[3 : 3+n])
+	if c == nil || c.Name() != name {
+		if c = lookupCodec(name); c == nil {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+		}
+	}
+
+	var d SessionData
+	if err := c.Unmarshal(data[3+n:], &d); err != nil {
+		return nil, err
+	}
+	return newSessionFromData(&d), nil
+}
+
+// decodeLegacySession decodes a session encoded directly with encoding/gob.
+func decodeLegacySession(data []byte) (Session, error) {
+	s := &sessionImpl{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(s); err != nil {
+		return nil, err
+	}
+
+	// gob does not transmit empty maps:
+	if s.AttrsF == nil {
+		s.AttrsF = make(map[string]interface{})
+	}
+	s.mux = &sync.RWMutex{}
+
+	return s, nil
+}
+
+// data returns the serializable state of the session.
+// Attribute maps are copied.
+func (s *sessionImpl) data() SessionData {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	d := SessionData{
+		ID:          s.IDF,
+		Created:     s.CreatedF,
+		Accessed:    s.AccessedF,
+		Modified:    s.ModifiedF,
+		CAttrs:      s.CAttrsF,
+		Attrs:       make(map[string]interface{}, len(s.AttrsF)),
+		Timeout:     s.TimeoutF,
+		MaxLifetime: s.MaxLifetimeF,
+		Version:     s.VersionF,
+	}
+	for k, v := range s.AttrsF {
+		d.Attrs[k] = v
+	}
+	return d
+}
+
+// newSessionFromData creates a session from its serializable state.
+func newSessionFromData(d *SessionData) *sessionImpl {
+	s := &sessionImpl{
+		IDF:          d.ID,
+		CreatedF:     d.Created,
+		AccessedF:    d.Accessed,
+		ModifiedF:    d.Modified,
+		CAttrsF:      d.CAttrs,
+		AttrsF:       d.Attrs,
+		TimeoutF:     d.Timeout,
+		MaxLifetimeF: d.MaxLifetime,
+		VersionF:     d.Version,
+		mux:          &sync.RWMutex{},
+	}
+	if len(s.CAttrsF) == 0 {
+		s.CAttrsF = nil
+	}
+	if s.AttrsF == nil {
+		s.AttrsF = make(map[string]interface{})
+	}
+	return s
+}
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+type testUser struct {
+	Name  string
+	Roles []string
+}
+
+func TestMarshalSession(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	gob.Register(testUser{})
+	jc := NewJSONCodec()
+	jc.Register(testUser{})
+
+	now := time.Now()
+	for _, c := range []Codec{GobCodec{}, jc} {
+		s := NewSessionOptions(&SessOptions{
+			CAttrs:      map[string]interface{}{"user": testUser{Name: "bob", Roles: []string{"admin"}}},
+			Attrs:       map[string]interface{}{"count": 3, "u8": uint8(4), "f": 1.5, "t": now, "d": time.Minute},
+			MaxLifetime: time.Hour,
+		})
+		s.SetAttr("s", "x")
+
+		data, err := MarshalSession(s, c)
+		eq(nil, err)
+		eq(byte(envelopeMagic), data[0])
+
+		s2, err := decodeSession(data, c)
+		eq(nil, err)
+		eq(s.ID(), s2.ID())
+		eq(true, s.Created().Equal(s2.Created()))
+		eq(true, s.Accessed().Equal(s2.Accessed()))
+		eq(true, s.Modified().Equal(s2.Modified()))
+		eq(s.Timeout(), s2.Timeout())
+		eq(s.MaxLifetime(), s2.MaxLifetime())
+		eq(s.Version(), s2.Version())
+		eq("bob", s2.CAttr("user").(testUser).Name)
+		eq(3, s2.Attr("count"))
+		eq(uint8(4), s2.Attr("u8"))
+		eq(1.5, s2.Attr("f"))
+		eq(true, now.Equal(s2.Attr("t").(time.Time)))
+		eq(time.Minute, s2.Attr("d"))
+		eq("x", s2.Attr("s"))
+
+		// Unmarshaled session must be fully functional:
+		neq(s.Mutex(), s2.Mutex())
+		s2.SetAttr("a", 1)
+		eq(1, s2.Attr("a"))
+		eq(nil, s.Attr("a"))
+	}
+
+	// Empty session:
+	s := NewSession()
+	data, err := MarshalSession(s, DefaultJSONCodec)
+	eq(nil, err)
+	s2, err := UnmarshalSession(data)
+	eq(nil, err)
+	eq(0, len(s2.Attrs()))
+	s2.SetAttr("a", 1)
+}
+
+func TestUnmarshalSessionErrors(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"u": testUser{}}})
+
+	// Type not registered:
+	_, err := MarshalSession(s, NewJSONCodec())
+	neq(nil, err)
+
+	jc := NewJSONCodec()
+	jc.Register(testUser{})
+	data, err := MarshalSession(s, jc)
+	eq(nil, err)
+	_, err = UnmarshalSession(data) // DefaultJSONCodec does not know testUser
+	neq(nil, err)
+
+	// Unknown codec:
+	data = append([]byte{envelopeMagic, envelopeVersion, 3}, "xml<session/>"...)
+	_, err = UnmarshalSession(data)
+	eq(true, errors.Is(err, ErrUnknownCodec))
+
+	// Unsupported envelope version and truncated envelopes:
+	_, err = UnmarshalSession([]byte{envelopeMagic, 99, 0})
+	neq(nil, err)
+	_, err = UnmarshalSession([]byte{envelopeMagic, envelopeVersion, 10, 'g'})
+	neq(nil, err)
+
+	// Wrapped sessions must be unwrapped, other implementations are not supported:
+	_, err = MarshalSession(&lazySession{Session: s}, jc)
+	eq(nil, err)
+	_, err = MarshalSession(struct{ Session }{s}, jc)
+	eq(errUnsupportedSession, err)
+}
+
+func TestUnmarshalLegacySession(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}}).(*sessionImpl)
+	buf := &bytes.Buffer{}
+	eq(nil, gob.NewEncoder(buf).Encode(s))
+
+	s2, err := UnmarshalSession(buf.Bytes())
+	eq(nil, err)
+	eq(s.ID(), s2.ID())
+	eq(1, s2.Attr("a"))
+	s2.SetAttr("b", 2)
+}
+
+func TestJSONCodecRegister(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	panics := func(f func()) (panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		f()
+		return
+	}
+
+	c := NewJSONCodec()
+	eq(false, panics(func() { c.Register(testUser{}) }))
+	eq(false, panics(func() { c.Register(testUser{}) }))
+	eq(true, panics(func() { c.RegisterName("int", testUser{}) }))
+	eq(true, panics(func() { c.RegisterName("user", testUser{}) }))
+	eq(false, panics(func() { c.RegisterName("userptr", &testUser{}) }))
+}
+
+func TestStoreCodec(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{Codec: DefaultJSONCodec, Logger: NoopLogger})
+	eq(nil, err)
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	st.Close()
+
+	// Sessions encoded with another registered codec must be decodable:
+	st, err = NewFileStoreOptions(dir, &FileStoreOptions{Logger: NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(1, s2.Attr("a"))
+}
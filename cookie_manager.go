@@ -7,19 +7,39 @@ A secure, cookie based session Manager implementation.
 package session
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // CookieManager is a secure, cookie based session Manager implementation.
 // Only the session ID is transmitted / stored at the clients, and it is managed using cookies.
+// CookieManager also implements ManagerCtx.
 type CookieManager struct {
-	store Store // Backing Store
+	store    Store    // Backing Store
+	storeCtx StoreCtx // Backing Store as a StoreCtx
 
 	sessIDCookieName string // Name of the cookie used for storing the session ID
 	cookieSecure     bool   // Tells if session ID cookies are to be sent only over HTTPS
 	cookieMaxAgeSec  int    // Max age for session ID cookies in seconds
 	cookiePath       string // Cookie path to use
+
+	cookieDomain      string        // Cookie domain to use, may be empty
+	cookieSameSite    http.SameSite // SameSite attribute of cookies, 0 means not set
+	cookieExpires     bool          // Tells if the Expires attribute is to be set alongside Max-Age
+	cookiePartitioned bool          // Tells if cookies are partitioned (CHIPS)
+
+	signingKeys [][]byte // Keys to sign / verify session ID cookies with, first is the current one
+
+	listeners *eventListeners // Listeners to notify about session lifecycle events
+	logger    *sessLogger     // Logger of session lifecycle events
+	limiter   *sessLimiter    // Limiter of concurrent sessions per principal, may be nil
 }
 
 // CookieMngrOptions defines options that may be passed when creating a new CookieManager.
@@ -32,11 +52,54 @@ type CookieMngrOptions struct {
 	// default value is false (only HTTPS)
 	AllowHTTP bool
 
-	// Max age for session ID cookies; default value is 30 days
+	// Max age for session ID cookies; default value is 30 days.
+	// If the session has a max lifetime (Session.MaxLifetime()), cookies will not outlive it:
+	// max age is capped to the remaining lifetime, and Expires is set to the end of it.
 	CookieMaxAge time.Duration
 
 	// Cookie path to use; default value is the root: "/"
 	CookiePath string
+
+	// Cookie domain to use; default value is empty, which means a host-only cookie.
+	CookieDomain string
+
+	// SameSite attribute of session ID cookies; default value is 0, which means the attribute is not set.
+	// http.SameSiteNoneMode requires secure cookies (AllowHTTP must be false).
+	CookieSameSite http.SameSite
+
+	// Tells if the Expires attribute is to be set alongside Max-Age (for clients not supporting Max-Age);
+	// default value is false.
+	CookieExpires bool
+
+	// Tells if session ID cookies are to be partitioned (CHIPS); default value is false.
+	// Partitioned cookies require secure cookies (AllowHTTP must be false).
+	CookiePartitioned bool
+
+	// Keys to sign session ID cookies with using HMAC-SHA256; default is to not sign cookies.
+	// The first key is the current one, used to sign new cookies; all keys are used to verify cookies,
+	// so to rotate keys, prepend a new key and keep the previous ones until their cookies expire.
+	// Cookies with invalid signatures are rejected without touching the backing Store.
+	// Keys should be random and at least 32 bytes long.
+	SigningKeys [][]byte
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// The manager can only report events it takes part in: sessions expiring in the backing store
+	// are not reported, register listeners on the store for that.
+	Listeners []EventListener
+
+	// Handler to emit structured log records of session lifecycle events with (see LogEvent), default is none.
+	// The manager can only log events it takes part in, like the listeners (see Listeners);
+	// session IDs rejected by the manager are logged too.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Max number of concurrent sessions per principal (e.g. user) and the policy to enforce it,
+	// default is no limit. The backing store must be indexed, see SessionLimit.
+	// If a new session is rejected, Add() does not add it (and sets no session ID in the response),
+	// it only logs the rejection with error level; AddCtx() reports ErrSessionLimit.
+	SessionLimit SessionLimit
 }
 
 // Pointer to zero value of CookieMngrOptions to be reused for efficiency.
@@ -49,12 +112,25 @@ func NewCookieManager(store Store) Manager {
 }
 
 // NewCookieManagerOptions creates a new, cookie based session Manager with the specified options.
+// To use a StoreCtx as the backing store, adapt it using NewStoreAdapter().
+//
+// NewCookieManagerOptions panics if the options are invalid (see CookieMngrOptions.Validate()).
+// If the options are not known in advance (e.g. they come from a configuration file),
+// call Validate() first to get an error instead.
 func NewCookieManagerOptions(store Store, o *CookieMngrOptions) Manager {
 	m := &CookieManager{
-		store:            store,
-		cookieSecure:     !o.AllowHTTP,
-		sessIDCookieName: o.SessIDCookieName,
-		cookiePath:       o.CookiePath,
+		store:             store,
+		storeCtx:          NewStoreCtxAdapter(store),
+		cookieSecure:      !o.AllowHTTP,
+		sessIDCookieName:  o.SessIDCookieName,
+		cookiePath:        o.CookiePath,
+		cookieDomain:      o.CookieDomain,
+		cookieSameSite:    o.CookieSameSite,
+		cookieExpires:     o.CookieExpires,
+		cookiePartitioned: o.CookiePartitioned,
+		signingKeys:       append([][]byte(nil), o.SigningKeys...),
+		listeners:         newEventListeners(o.Listeners),
+		logger:            newSlogLogger(o.LogHandler, o.LogLevels),
 	}
 
 	if m.sessIDCookieName == "" {
@@ -69,52 +145,282 @@ func NewCookieManagerOptions(store Store, o *CookieMngrOptions) Manager {
 		m.cookiePath = "/"
 	}
 
+	if err := o.Validate(store); err != nil {
+		panic(err)
+	}
+	m.limiter, _ = newSessLimiter(o.SessionLimit, store)
+
 	return m
 }
 
+// Validate checks if the options are valid for creating a CookieManager with the given backing store
+// (see NewCookieManagerOptions()). The options are invalid
+// if the cookie name has the "__Secure-" prefix but cookies are allowed over HTTP;
+// if the cookie name has the "__Host-" prefix but cookies are allowed over HTTP, a domain is set or
+// the path is not "/" (the default); if SameSite is None or cookies are partitioned but cookies are allowed over HTTP;
+// if a session limit is set but the store is not indexed.
+func (o *CookieMngrOptions) Validate(store Store) error {
+	secure := !o.AllowHTTP
+	path := o.CookiePath
+	if path == "" {
+		path = "/"
+	}
+
+	switch name := o.SessIDCookieName; {
+	case strings.HasPrefix(name, "__Secure-"):
+		if !secure {
+			return fmt.Errorf("session: cookie %q requires secure cookies", name)
+		}
+	case strings.HasPrefix(name, "__Host-"):
+		if !secure {
+			return fmt.Errorf("session: cookie %q requires secure cookies", name)
+		}
+		if o.CookieDomain != "" {
+			return fmt.Errorf("session: cookie %q must not have a domain", name)
+		}
+		if path != "/" {
+			return fmt.Errorf("session: cookie %q must have path \"/\"", name)
+		}
+	}
+
+	if o.CookieSameSite == http.SameSiteNoneMode && !secure {
+		return fmt.Errorf("session: SameSite=None requires secure cookies")
+	}
+	if o.CookiePartitioned && !secure {
+		return fmt.Errorf("session: partitioned cookies require secure cookies")
+	}
+
+	_, err := newSessLimiter(o.SessionLimit, store)
+	return err
+}
+
 // Get is to implement Manager.Get().
 func (m *CookieManager) Get(r *http.Request) Session {
-	c, err := r.Cookie(m.sessIDCookieName)
-	if err != nil {
+	id, _, ok := m.sessID(r)
+	if !ok {
 		return nil
 	}
 
-	return m.store.Get(c.Value)
+	sess := m.store.Get(id)
+	if sess != nil {
+		m.logger.accessed(sess)
+		m.listeners.accessed(sess)
+	}
+	return sess
 }
 
 // Add is to implement Manager.Add().
 func (m *CookieManager) Add(sess Session, w http.ResponseWriter) {
+	if m.limiter != nil {
+		if err := m.AddCtx(context.Background(), sess, w); err != nil {
+			logAddFailure(m.logger, sess, err)
+		}
+		return
+	}
+	m.setCookie(sess, w)
+	m.store.Add(sess)
+	m.logger.added(sess)
+	m.listeners.added(sess)
+}
+
+// Remove is to implement Manager.Remove().
+func (m *CookieManager) Remove(sess Session, w http.ResponseWriter) {
+	m.removeCookie(w)
+	m.store.Remove(sess)
+	m.logger.removed(sess)
+	m.listeners.removed(sess)
+}
+
+// Regenerate is to implement Manager.Regenerate().
+func (m *CookieManager) Regenerate(sess Session, w http.ResponseWriter) Session {
+	sess2, err := m.RegenerateCtx(context.Background(), sess, w)
+	if err != nil {
+		return nil
+	}
+	return sess2
+}
+
+// GetCtx is to implement ManagerCtx.GetCtx().
+func (m *CookieManager) GetCtx(r *http.Request) (Session, error) {
+	id, _, ok := m.sessID(r)
+	if !ok {
+		return nil, nil
+	}
+
+	sess, err := m.storeCtx.GetCtx(r.Context(), id)
+	if sess != nil {
+		m.logger.accessed(sess)
+		m.listeners.accessed(sess)
+	}
+	return sess, redactErr(err, id)
+}
+
+// AddCtx is to implement ManagerCtx.AddCtx().
+func (m *CookieManager) AddCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	if err := addLimited(ctx, m.limiter, m.storeCtx, sess, m.logger, m.listeners); err != nil {
+		return err
+	}
+	m.setCookie(sess, w)
+	m.logger.added(sess)
+	m.listeners.added(sess)
+	return nil
+}
+
+// RemoveCtx is to implement ManagerCtx.RemoveCtx().
+func (m *CookieManager) RemoveCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	m.removeCookie(w)
+	if err := m.storeCtx.RemoveCtx(ctx, sess); err != nil {
+		return err
+	}
+	m.logger.removed(sess)
+	m.listeners.removed(sess)
+	return nil
+}
+
+// RegenerateCtx is to implement ManagerCtx.RegenerateCtx().
+func (m *CookieManager) RegenerateCtx(ctx context.Context, sess Session, w http.ResponseWriter) (Session, error) {
+	if sess2, ok := addLazy(sess); ok {
+		return sess2, nil
+	}
+	sess2, err := regenerate(ctx, m.storeCtx, sess)
+	if err != nil {
+		return nil, err
+	}
+	setSuccessor(sess, sess2) // So the Middleware saves the new session
+	m.setCookie(sess2, w)
+	m.logger.regenerated(sess, sess2)
+	m.listeners.removed(sess)
+	m.listeners.created(sess2)
+	return sess2, nil
+}
+
+// setCookie sets the session ID cookie of the session in the HTTP response.
+func (m *CookieManager) setCookie(sess Session, w http.ResponseWriter) {
 	// HttpOnly: do not allow non-HTTP access to it (like javascript) to prevent stealing it...
 	// Secure: only send it over HTTPS
 	// MaxAge: to specify the max age of the cookie in seconds, else it's a session cookie and gets deleted after the browser is closed.
 
-	c := http.Cookie{
-		Name:     m.sessIDCookieName,
-		Value:    sess.ID(),
-		Path:     m.cookiePath,
-		HttpOnly: true,
-		Secure:   m.cookieSecure,
-		MaxAge:   m.cookieMaxAgeSec,
+	c := m.cookie()
+	c.Value = m.sign(sess.ID())
+	c.MaxAge = m.cookieMaxAgeSec
+	if m.cookieExpires {
+		c.Expires = time.Now().Add(time.Duration(m.cookieMaxAgeSec) * time.Second)
 	}
+	capCookieMaxAge(&c, sess)
+
 	http.SetCookie(w, &c)
+}
 
-	m.store.Add(sess)
+// Resign re-signs the session ID cookie with the current signing key if the request's cookie
+// is valid but was signed with a previous key, so clients transparently migrate to the current key.
+// sess must be the session of the request (e.g. returned by Get()).
+// Cookies are also signed with the current key each time they are set (e.g. Add(), Regenerate()).
+func (m *CookieManager) Resign(sess Session, r *http.Request, w http.ResponseWriter) {
+	id, keyIdx, ok := m.sessID(r)
+	if ok && keyIdx > 0 && id == sess.ID() {
+		m.setCookie(sess, w)
+	}
 }
 
-// Remove is to implement Manager.Remove().
-func (m *CookieManager) Remove(sess Session, w http.ResponseWriter) {
+// sessID returns the session ID from the session ID cookie of the request,
+// and the index of the signing key that verified it.
+// ok is false if there is no session ID cookie, or its signature is invalid.
+func (m *CookieManager) sessID(r *http.Request) (id string, keyIdx int, ok bool) {
+	c, err := r.Cookie(m.sessIDCookieName)
+	if err != nil {
+		return "", 0, false
+	}
+	if len(m.signingKeys) == 0 {
+		return c.Value, 0, true
+	}
+
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		m.logger.rejected("missing_signature")
+		return "", 0, false
+	}
+	id = c.Value[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(c.Value[i+1:])
+	if err != nil {
+		m.logger.rejected("invalid_signature")
+		return "", 0, false
+	}
+	for keyIdx, key := range m.signingKeys {
+		if hmac.Equal(mac, m.mac(key, id)) {
+			return id, keyIdx, true
+		}
+	}
+	m.logger.rejected("invalid_signature")
+	return "", 0, false
+}
+
+// sign returns the cookie value for the session ID: the ID and its signature
+// with the current signing key, or the ID as-is if there are no signing keys.
+func (m *CookieManager) sign(id string) string {
+	if len(m.signingKeys) == 0 {
+		return id
+	}
+	return id + "." + base64.RawURLEncoding.EncodeToString(m.mac(m.signingKeys[0], id))
+}
+
+// mac computes the HMAC of the session ID with the given key.
+// The cookie name is also included, so signatures cannot be reused in other cookies.
+func (m *CookieManager) mac(key []byte, id string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(m.sessIDCookieName))
+	h.Write([]byte{'='})
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// capCookieMaxAge caps the max age of the cookie to the remaining lifetime of the session,
+// and sets its Expires to the end of the lifetime if the session has a max lifetime:
+// the cookie is useless after that, so don't let it outlive the session.
+func capCookieMaxAge(c *http.Cookie, sess Session) {
+	ml := sess.MaxLifetime()
+	if ml <= 0 {
+		return
+	}
+
+	end := sess.Created().Add(ml)
+	remainingSec := int((time.Until(end) + time.Second - 1) / time.Second) // Round up
+	if remainingSec < 1 {
+		remainingSec = 1 // MaxAge=0 would mean no Max-Age attribute
+	}
+	if remainingSec < c.MaxAge {
+		c.MaxAge = remainingSec
+		c.Expires = end
+	}
+}
+
+// removeCookie sets the session ID cookie in the HTTP response to be deleted.
+func (m *CookieManager) removeCookie(w http.ResponseWriter) {
 	// Set the cookie with empty value and 0 max age
-	c := http.Cookie{
-		Name:     m.sessIDCookieName,
-		Value:    "",
-		Path:     m.cookiePath,
-		HttpOnly: true,
-		Secure:   m.cookieSecure,
-		MaxAge:   -1, // MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
+	c := m.cookie()
+	c.MaxAge = -1 // MaxAge<0 means delete cookie now, equivalently 'Max-Age: 0'
+	if m.cookieExpires {
+		c.Expires = time.Unix(1, 0) // Unix epoch, http.Cookie ignores the zero time
 	}
 	http.SetCookie(w, &c)
+}
 
-	m.store.Remove(sess)
+// cookie returns a session ID cookie with the attributes common to setting and deleting it.
+func (m *CookieManager) cookie() http.Cookie {
+	return http.Cookie{
+		Name:        m.sessIDCookieName,
+		Path:        m.cookiePath,
+		Domain:      m.cookieDomain,
+		HttpOnly:    true,
+		Secure:      m.cookieSecure,
+		SameSite:    m.cookieSameSite,
+		Partitioned: m.cookiePartitioned,
+	}
+}
+
+// Save is to implement Saver.Save().
+// It saves the session in the backing store if the store implements Saver.
+func (m *CookieManager) Save(ctx context.Context, sess Session) error {
+	return save(ctx, m.storeCtx, sess)
 }
 
 // Close is to implement Manager.Close().
@@ -141,3 +447,23 @@ func (m *CookieManager) CookieMaxAgeSec() int {
 func (m *CookieManager) CookiePath() string {
 	return m.cookiePath
 }
+
+// CookieDomain returns the used cookie domain.
+func (m *CookieManager) CookieDomain() string {
+	return m.cookieDomain
+}
+
+// CookieSameSite returns the SameSite attribute of session ID cookies, 0 means the attribute is not set.
+func (m *CookieManager) CookieSameSite() http.SameSite {
+	return m.cookieSameSite
+}
+
+// CookieExpires tells if the Expires attribute is set alongside Max-Age.
+func (m *CookieManager) CookieExpires() bool {
+	return m.cookieExpires
+}
+
+// CookiePartitioned tells if session ID cookies are partitioned.
+func (m *CookieManager) CookiePartitioned() bool {
+	return m.cookiePartitioned
+}
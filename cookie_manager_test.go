@@ -1,6 +1,9 @@
 package session
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -25,3 +28,253 @@ func TestCookieManager(t *testing.T) {
 	eq(int(o.CookieMaxAge/time.Second), cmgr.CookieMaxAgeSec())
 	eq(o.CookiePath, cmgr.CookiePath())
 }
+
+func TestCookieManagerCtx(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true}).(ManagerCtx)
+	defer mgr.Close()
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	eq(nil, mgr.AddCtx(context.Background(), s, w))
+	cookies := w.Result().Cookies()
+	eq(1, len(cookies))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	got, err := mgr.GetCtx(r)
+	eq(nil, err)
+	eq(s, got)
+
+	got, err = mgr.GetCtx(httptest.NewRequest("GET", "/", nil))
+	eq(nil, err)
+	eq(nil, got)
+
+	// Store failures must be reported, and no cookie must be set on failed add:
+	mgr2 := NewCookieManager(NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{Logger: NoopLogger})).(ManagerCtx)
+	w = httptest.NewRecorder()
+	eq(errTestStore, mgr2.AddCtx(context.Background(), s, w))
+	eq(0, len(w.Result().Cookies()))
+
+	_, err = mgr2.GetCtx(r)
+	eq(errTestStore, err)
+
+	w = httptest.NewRecorder()
+	neq(nil, mgr2.RemoveCtx(context.Background(), s, w))
+	eq(1, len(w.Result().Cookies()))
+}
+
+func TestCookieManagerRegenerate(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	mgr.Add(s, httptest.NewRecorder())
+
+	w := httptest.NewRecorder()
+	s2 := mgr.Regenerate(s, w)
+	neq(nil, s2)
+	neq(s.ID(), s2.ID())
+	eq(1, s2.Attr("a"))
+	eq(nil, st.Get(s.ID()))
+
+	cookies := w.Result().Cookies()
+	eq(1, len(cookies))
+	eq(s2.ID(), cookies[0].Value)
+
+	// Regeneration failure:
+	mgr2 := NewCookieManager(NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{Logger: NoopLogger}))
+	w = httptest.NewRecorder()
+	eq(nil, mgr2.Regenerate(s2, w))
+	eq(0, len(w.Result().Cookies()))
+}
+
+func TestCookieManagerRegenerateRevoked(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	l := &recordingListener{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, IndexCAttr: "UserName"})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true, Listeners: []EventListener{l}})
+	defer mgr.Close()
+
+	// Sessions revoked by "log out everywhere" cannot be revived:
+	s := newUserSession("alice")
+	mgr.Add(s, httptest.NewRecorder())
+	_, err := st.(IndexedStore).RemoveIndexed(ctx, "alice")
+	eq(nil, err)
+	l.take()
+
+	w := httptest.NewRecorder()
+	eq(nil, mgr.Regenerate(s, w))
+	eq(0, len(w.Result().Cookies()))
+	eq(nil, st.Get(s.ID()))
+	eq(0, len(l.take()))
+
+	_, err = mgr.(ManagerCtx).RegenerateCtx(ctx, s, httptest.NewRecorder())
+	eq(ErrSessionNotFound, err)
+}
+
+func TestCookieManagerMaxLifetime(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{CookieMaxAge: time.Hour})
+	defer mgr.Close()
+
+	// Max lifetime shorter than cookie max age:
+	s := NewSessionOptions(&SessOptions{MaxLifetime: time.Minute})
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+	c := w.Result().Cookies()[0]
+	eq(60, c.MaxAge)
+	eq(s.Created().Add(time.Minute).Unix(), c.Expires.Unix())
+
+	// Max lifetime longer than cookie max age:
+	s = NewSessionOptions(&SessOptions{MaxLifetime: 2 * time.Hour})
+	w = httptest.NewRecorder()
+	mgr.Add(s, w)
+	c = w.Result().Cookies()[0]
+	eq(3600, c.MaxAge)
+	eq(true, c.Expires.IsZero())
+}
+
+func TestCookieManagerSigning(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	k1, k2 := []byte("key-1-0123456789abcdef0123456789"), []byte("key-2-0123456789abcdef0123456789")
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+	mgr1 := NewCookieManagerOptions(st, &CookieMngrOptions{SigningKeys: [][]byte{k1}}).(*CookieManager)
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr1.Add(s, w)
+	c := w.Result().Cookies()[0]
+	neq(s.ID(), c.Value)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	eq(s, mgr1.Get(r))
+
+	// Tampered cookies must be rejected without touching the store:
+	for _, v := range []string{s.ID(), c.Value + "x", "x" + c.Value, NewSession().ID() + c.Value[len(s.ID()):]} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: v})
+		eq(nil, mgr1.Get(r))
+
+		mgrErr := NewCookieManagerOptions(NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{Logger: NoopLogger}),
+			&CookieMngrOptions{SigningKeys: [][]byte{k1}}).(ManagerCtx)
+		sess, err := mgrErr.GetCtx(r)
+		eq(nil, sess)
+		eq(nil, err)
+	}
+
+	// Key rotation: previous keys are accepted, cookies are re-signed with the current key:
+	mgr2 := NewCookieManagerOptions(st, &CookieMngrOptions{SigningKeys: [][]byte{k2, k1}}).(*CookieManager)
+	eq(s, mgr2.Get(r))
+	w = httptest.NewRecorder()
+	mgr2.Resign(s, r, w)
+	cookies := w.Result().Cookies()
+	eq(1, len(cookies))
+	neq(c.Value, cookies[0].Value)
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.AddCookie(cookies[0])
+	eq(s, mgr2.Get(r2))
+
+	// Cookies signed with the current key are not re-signed:
+	w = httptest.NewRecorder()
+	mgr2.Resign(s, r2, w)
+	eq(0, len(w.Result().Cookies()))
+
+	// Once the previous key is dropped, old cookies are rejected:
+	mgr3 := NewCookieManagerOptions(st, &CookieMngrOptions{SigningKeys: [][]byte{k2}})
+	eq(nil, mgr3.Get(r))
+	eq(s, mgr3.Get(r2))
+}
+
+func TestCookieManagerAttributes(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{
+		SessIDCookieName:  "__Secure-sid",
+		CookieDomain:      "example.com",
+		CookieSameSite:    http.SameSiteNoneMode,
+		CookieExpires:     true,
+		CookiePartitioned: true,
+	})
+	defer mgr.Close()
+
+	cmgr := mgr.(*CookieManager)
+	eq("example.com", cmgr.CookieDomain())
+	eq(http.SameSiteNoneMode, cmgr.CookieSameSite())
+	eq(true, cmgr.CookieExpires())
+	eq(true, cmgr.CookiePartitioned())
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+	c := w.Result().Cookies()[0]
+	eq("example.com", c.Domain)
+	eq(http.SameSiteNoneMode, c.SameSite)
+	eq(true, c.Partitioned)
+	eq(true, c.Secure)
+	eq(false, c.Expires.IsZero())
+
+	w = httptest.NewRecorder()
+	mgr.Remove(s, w)
+	c = w.Result().Cookies()[0]
+	eq("example.com", c.Domain)
+	eq(http.SameSiteNoneMode, c.SameSite)
+	eq(true, c.Expires.Before(time.Now()))
+
+	// Without CookieExpires no Expires attribute is set:
+	mgr2 := NewCookieManagerOptions(st, &CookieMngrOptions{SessIDCookieName: "__Host-sid"})
+	w = httptest.NewRecorder()
+	mgr2.Add(s, w)
+	c = w.Result().Cookies()[0]
+	eq(true, c.Expires.IsZero())
+	eq(http.SameSite(0), c.SameSite)
+}
+
+func TestCookieManagerValidation(t *testing.T) {
+	panics := func(o *CookieMngrOptions) (panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		NewCookieManagerOptions(nil, o)
+		return
+	}
+
+	cases := []struct {
+		o     *CookieMngrOptions
+		valid bool
+	}{
+		{&CookieMngrOptions{}, true},
+		{&CookieMngrOptions{AllowHTTP: true, CookieSameSite: http.SameSiteLaxMode}, true},
+		{&CookieMngrOptions{AllowHTTP: true, CookieSameSite: http.SameSiteNoneMode}, false},
+		{&CookieMngrOptions{AllowHTTP: true, CookiePartitioned: true}, false},
+		{&CookieMngrOptions{SessIDCookieName: "__Secure-sid", CookieDomain: "example.com", CookiePath: "/a"}, true},
+		{&CookieMngrOptions{SessIDCookieName: "__Secure-sid", AllowHTTP: true}, false},
+		{&CookieMngrOptions{SessIDCookieName: "__Host-sid"}, true},
+		{&CookieMngrOptions{SessIDCookieName: "__Host-sid", AllowHTTP: true}, false},
+		{&CookieMngrOptions{SessIDCookieName: "__Host-sid", CookieDomain: "example.com"}, false},
+		{&CookieMngrOptions{SessIDCookieName: "__Host-sid", CookiePath: "/a"}, false},
+	}
+	for i, c := range cases {
+		if got := c.o.Validate(nil) == nil; got != c.valid {
+			t.Errorf("[i=%d] Expected valid: %v, got: %v", i, c.valid, got)
+		}
+		if got := panics(c.o); got == c.valid {
+			t.Errorf("[i=%d] Expected panic: %v, got: %v", i, !c.valid, got)
+		}
+	}
+}
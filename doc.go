@@ -51,10 +51,155 @@ And to access these attributes and change value of "Count":
 
 (Of course variable attributes can be added later on too with Session.SetAttr(), not just at session creation.)
 
+To avoid type assertions that may panic, use the generic accessors. GetAttr() reports if the attribute exists with the
+expected type, and a typed Key carries the default value of the attribute:
+
+    userName, ok := session.GetCAttr[string](sess, "UserName")
+
+    var countKey = session.NewKey("Count", 0)
+    countKey.Set(sess, countKey.Get(sess)+1) // Increment count
+
+Attr() followed by SetAttr() is not atomic. To modify attributes atomically, use Session.Update()
+(or Session.CompareAndSwapAttr()):
+
+    sess.Update(func(attrs map[string]interface{}) {
+        attrs["Count"] = attrs["Count"].(int) + 1
+    })
+
+Stores which decode sessions on each access (e.g. SQL and Redis stores) return a new Session value for each request,
+so use UpdateInStore() with them, which detects concurrent modifications using session versions and retries.
+
+If an existing session's privilege level changes (e.g. an anonymous session on login), change its ID
+to prevent session fixation attacks. Attributes are kept, the old ID is invalidated:
+
+    sess = session.Regenerate(sess, w)
+
+Sessions which are not in the store anymore (e.g. removed on logout or expired) cannot be regenerated,
+so revoked sessions cannot be revived: Regenerate() returns nil.
+
 To remove a session (e.g. on logout):
 
     session.Remove(sess, w)
 
+Instead of calling session.Get() in each handler, you may use a middleware which resolves the session
+once per request, and stores it in the request context:
+
+    http.Handle("/", session.Middleware(session.Global, myHandler))
+
+    // And in myHandler:
+    sess := session.FromContext(r.Context())
+
+The middleware also saves the session at the end of the request if the store does not persist changes
+automatically (see Saver): modified sessions are saved, for others only the access is recorded.
+
+The attributes of session ID cookies may be set with the options of CookieManager: besides the path and max age,
+the Domain, SameSite, Expires and Partitioned attributes. The rules of the "__Secure-" and "__Host-" cookie name
+prefixes are enforced. NewCookieManagerOptions() panics if the options are invalid; to get an error instead
+(e.g. if the options come from a configuration file), check them with Validate() first:
+
+    o := &session.CookieMngrOptions{
+        SessIDCookieName: "__Host-sessid",
+        CookieSameSite:   http.SameSiteLaxMode,
+    }
+    store := session.NewInMemStore()
+    if err := o.Validate(store); err != nil {
+        log.Fatal(err)
+    }
+    session.Global.Close()
+    session.Global = session.NewCookieManagerOptions(store, o)
+
+Sessions may be marshaled (e.g. to store them in a custom Store) with MarshalSession() using a Codec
+(GobCodec or JSONCodec), and unmarshaled with UnmarshalSession(). The provided persistent stores
+use GobCodec by default, which may be changed with the Codec field of their options.
+
+To clean up per-user resources when sessions time out or to emit audit records, register an EventListener
+with the Listeners field of the options of stores and managers. Listeners are notified when sessions are
+created, accessed, removed or expire, and when their attributes change (embed NoopEventListener to only
+implement some of the methods):
+
+    type auditListener struct {
+        session.NoopEventListener
+    }
+
+    func (auditListener) OnExpired(sess session.Session) {
+        log.Println("Session expired:", session.IDHash(sess.ID()))
+    }
+
+    session.Global.Close()
+    session.Global = session.NewCookieManager(session.NewInMemStoreOptions(&session.InMemStoreOptions{
+        Listeners: []session.EventListener{auditListener{}},
+    }))
+
+Stores log session lifecycle events as text using the Logger field of their options.
+For structured logging, set the LogHandler field to a slog.Handler: records carry the event (see LogEvent),
+the fingerprint of the session ID (never the raw ID), the reason, the remaining lifetime and the
+number of attributes of the session. Levels of events may be changed with the LogLevels field:
+
+    session.Global.Close()
+    session.Global = session.NewCookieManager(session.NewInMemStoreOptions(&session.InMemStoreOptions{
+        LogHandler: slog.NewJSONHandler(os.Stderr, nil),
+        LogLevels:  map[session.LogEvent]slog.Level{session.LogAccessed: slog.LevelInfo},
+    }))
+
+Session IDs are bearer credentials, so they are never logged, only their fingerprints (by default a SHA-256
+based hash, see IDHash()). The fingerprinting function may be changed, e.g. to a keyed hash:
+
+    session.SetIDFingerprint(session.HMACFingerprint(key))
+
+For debugging, full IDs may be logged with SetLogFullIDs(true), but only in builds with the "sessiondebug" build tag.
+
+To find or revoke all sessions of a user (e.g. to log out the user everywhere), the in-memory store can
+maintain an index of sessions by a constant attribute, set with the IndexCAttr field of its options.
+The store then implements IndexedStore:
+
+    st := session.NewInMemStoreOptions(&session.InMemStoreOptions{IndexCAttr: "UserName"})
+
+    // On "log out everywhere":
+    n, err := st.(session.IndexedStore).RemoveIndexed(ctx, userName)
+
+Managers backed by an indexed store can limit the number of concurrent sessions per user with the
+SessionLimit field of their options: when the limit would be exceeded, new sessions are either rejected
+(AddCtx() reports ErrSessionLimit) or the least recently accessed sessions of the user are evicted:
+
+    session.Global = session.NewCookieManagerOptions(st, &session.CookieMngrOptions{
+        SessionLimit: session.SessionLimit{Max: 3, Policy: session.LimitEvictLRU},
+    })
+
+To bound the memory used by the in-memory store, set the MaxSessions and / or MaxBytes fields of its options.
+When adding a session would exceed them, the least recently accessed sessions are evicted (which is logged,
+and reported to listeners as removal). Sizes of sessions are only estimated, so treat MaxBytes as approximate:
+
+    st := session.NewInMemStoreOptions(&session.InMemStoreOptions{MaxSessions: 100000, MaxBytes: 256 << 20})
+
+Under heavy concurrent load, the single lock of the in-memory store may become a bottleneck.
+Set the Shards field of its options to distribute sessions among shards by the hash of their IDs,
+each shard having its own lock and being swept by the session cleaner separately:
+
+    st := session.NewInMemStoreOptions(&session.InMemStoreOptions{Shards: 16})
+
+The bounds of a sharded store (MaxSessions and MaxBytes) are divided evenly among its shards,
+each shard evicting its own least recently accessed sessions.
+
+Sessions of the in-memory store are lost on restart, unless the SnapshotFile field of its options is set:
+sessions are then restored from the file when the store is created, and saved to it when the store is closed
+(and periodically, if SnapshotInterval is set). Sessions that expired while the process was down are
+reported as expired. Snapshots may also be taken manually, as the store implements SnapshotStore:
+
+    st := session.NewInMemStoreOptions(&session.InMemStoreOptions{
+        SnapshotFile:     "/var/lib/myapp/sessions.snap",
+        SnapshotInterval: time.Minute,
+    })
+
+Changes made since the last snapshot are lost on a crash. To avoid that, set the JournalFile field:
+additions, removals, attribute changes and accesses of sessions are then appended to a journal, which is replayed
+when the store is created, and compacted into the snapshot file in the background. When the journal is synced to
+stable storage is controlled by the JournalSync field (SyncAlways by default, SyncInterval or SyncNever):
+
+    st := session.NewInMemStoreOptions(&session.InMemStoreOptions{
+        JournalFile: "/var/lib/myapp/sessions.journal",
+        JournalSync: session.SyncInterval,
+    })
+
 Check out the session demo application which shows all these in action:
 
 https://github.com/icza/session/blob/master/session_demo/session_demo.go
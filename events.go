@@ -0,0 +1,165 @@
+/*
+
+Session lifecycle event listeners.
+
+*/
+
+package session
+
+// EventListener is the interface of session lifecycle event listeners.
+// Listeners may be registered on stores and managers using the Listeners field of their options.
+//
+// Methods are called synchronously, after the event occurred (not holding any locks of the
+// store or manager, so it is safe to call their methods), so they should return quickly.
+// Methods may be called concurrently from multiple goroutines.
+type EventListener interface {
+	// OnCreated is called when a new session is added to the store or manager.
+	// A regenerated session (see Regenerator) is reported as created
+	// (and the session it replaces as removed).
+	OnCreated(sess Session)
+
+	// OnAccessed is called when a session is accessed (retrieved by its ID).
+	OnAccessed(sess Session)
+
+	// OnAttrChanged is called when an attribute of a session which has been created or accessed
+	// through the store or manager is changed, with the old and new values of the attribute
+	// (nil means the attribute does not exist).
+	OnAttrChanged(sess Session, name string, old, new interface{})
+
+	// OnRemoved is called when a session is removed explicitly (e.g. on logout).
+	OnRemoved(sess Session)
+
+	// OnExpired is called when a session is removed because it has expired
+	// (timed out or exceeded its max lifetime).
+	OnExpired(sess Session)
+}
+
+// NoopEventListener is an EventListener whose methods do nothing.
+// It may be embedded in types which only want to implement some of the methods of EventListener.
+type NoopEventListener struct{}
+
+// OnCreated is to implement EventListener.OnCreated().
+func (NoopEventListener) OnCreated(sess Session) {}
+
+// OnAccessed is to implement EventListener.OnAccessed().
+func (NoopEventListener) OnAccessed(sess Session) {}
+
+// OnAttrChanged is to implement EventListener.OnAttrChanged().
+func (NoopEventListener) OnAttrChanged(sess Session, name string, old, new interface{}) {}
+
+// OnRemoved is to implement EventListener.OnRemoved().
+func (NoopEventListener) OnRemoved(sess Session) {}
+
+// OnExpired is to implement EventListener.OnExpired().
+func (NoopEventListener) OnExpired(sess Session) {}
+
+// eventListeners is the group of listeners registered on a store or manager.
+// Methods may be called on a nil value, which means there are no listeners.
+type eventListeners struct {
+	ls []EventListener
+}
+
+// newEventListeners returns the group of the given listeners, nil if there are none.
+func newEventListeners(ls []EventListener) *eventListeners {
+	if len(ls) == 0 {
+		return nil
+	}
+	return &eventListeners{ls: append([]EventListener(nil), ls...)}
+}
+
+// attach attaches the listeners to the session, so they are notified of its attribute changes.
+// Reports whether they were not yet attached.
+func (e *eventListeners) attach(sess Session) bool {
+	if e == nil {
+		return false
+	}
+	s, ok := toImpl(sess)
+	if !ok {
+		return false
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, e2 := range s.listeners {
+		if e2 == e {
+			return false
+		}
+	}
+	s.listeners = append(s.listeners, e)
+	return true
+}
+
+// added notifies the listeners about a session being added: OnCreated is called
+// if the session has not yet been created or accessed through the listeners' store or manager.
+func (e *eventListeners) added(sess Session) {
+	if e.attach(sess) {
+		for _, l := range e.ls {
+			l.OnCreated(sess)
+		}
+	}
+}
+
+// created notifies the listeners about a session being created.
+func (e *eventListeners) created(sess Session) {
+	if e == nil {
+		return
+	}
+	e.attach(sess)
+	for _, l := range e.ls {
+		l.OnCreated(sess)
+	}
+}
+
+// accessed notifies the listeners about a session being accessed.
+func (e *eventListeners) accessed(sess Session) {
+	if e == nil {
+		return
+	}
+	e.attach(sess)
+	for _, l := range e.ls {
+		l.OnAccessed(sess)
+	}
+}
+
+// attrChanged notifies the listeners about an attribute change.
+func (e *eventListeners) attrChanged(sess Session, name string, old, new interface{}) {
+	for _, l := range e.ls {
+		l.OnAttrChanged(sess, name, old, new)
+	}
+}
+
+// removed notifies the listeners about a session being removed.
+func (e *eventListeners) removed(sess Session) {
+	if e == nil {
+		return
+	}
+	for _, l := range e.ls {
+		l.OnRemoved(sess)
+	}
+}
+
+// expired notifies the listeners about a session being expired.
+func (e *eventListeners) expired(sess Session) {
+	if e == nil {
+		return
+	}
+	for _, l := range e.ls {
+		l.OnExpired(sess)
+	}
+}
+
+// attrChange is an attribute change of a session.
+type attrChange struct {
+	name     string
+	old, new interface{}
+}
+
+// notifyAttrChanges notifies the listeners about attribute changes of the session.
+func notifyAttrChanges(sess Session, ls []*eventListeners, changes ...attrChange) {
+	for _, e := range ls {
+		for _, c := range changes {
+			e.attrChanged(sess, c.name, c.old, c.new)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// recordingListener is an EventListener which records the events it receives.
+type recordingListener struct {
+	mux    sync.Mutex
+	events []string
+}
+
+func (l *recordingListener) record(event string, sess Session) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.events = append(l.events, event+":"+sess.ID())
+}
+
+func (l *recordingListener) OnCreated(sess Session)  { l.record("created", sess) }
+func (l *recordingListener) OnAccessed(sess Session) { l.record("accessed", sess) }
+func (l *recordingListener) OnRemoved(sess Session)  { l.record("removed", sess) }
+func (l *recordingListener) OnExpired(sess Session)  { l.record("expired", sess) }
+
+func (l *recordingListener) OnAttrChanged(sess Session, name string, old, new interface{}) {
+	l.record(fmt.Sprintf("attr %s %v->%v", name, old, new), sess)
+}
+
+// take returns the recorded events, and clears them.
+func (l *recordingListener) take() []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+func TestEventListenersInMem(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              NoopLogger,
+		Listeners:           []EventListener{l},
+	})
+	defer st.Close()
+
+	s := NewSession()
+	id := s.ID()
+	st.Add(s)
+	st.Add(s) // Adding again (saving) is not a creation
+	eq(s, st.Get(id))
+	s.SetAttr("a", 1)
+	s.CompareAndSwapAttr("a", 1, 2)
+	s.SetAttr("a", nil)
+	eq(true, reflect.DeepEqual([]string{
+		"created:" + id,
+		"accessed:" + id,
+		"attr a <nil>->1:" + id,
+		"attr a 1->2:" + id,
+		"attr a 2-><nil>:" + id,
+	}, l.take()))
+
+	s2, err := st.(Regenerator).Regenerate(context.Background(), s)
+	eq(nil, err)
+	s2.SetAttr("b", 1)
+	s.SetAttr("c", 1) // Old session is no longer tracked by the store, but listeners are still attached
+	eq(true, reflect.DeepEqual([]string{
+		"removed:" + id,
+		"created:" + s2.ID(),
+		"attr b <nil>->1:" + s2.ID(),
+		"attr c <nil>->1:" + id,
+	}, l.take()))
+
+	st.Remove(s2)
+	st.Remove(s2) // Not in the store anymore
+	eq(true, reflect.DeepEqual([]string{"removed:" + s2.ID()}, l.take()))
+
+	s3 := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(s3)
+	time.Sleep(60 * time.Millisecond)
+	eq(true, reflect.DeepEqual([]string{"created:" + s3.ID(), "expired:" + s3.ID()}, l.take()))
+}
+
+func TestEventListenersFileStoreExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{Logger: NoopLogger})
+	eq(nil, err)
+	s := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond, Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	st.Close()
+
+	// Expired sessions are reported even if they are not cached:
+	l := &recordingListener{}
+	st, err = NewFileStoreOptions(dir, &FileStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              NoopLogger,
+		Listeners:           []EventListener{l},
+	})
+	eq(nil, err)
+	defer st.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	eq(true, reflect.DeepEqual([]string{"expired:" + s.ID()}, l.take()))
+}
+
+func TestEventListenersManager(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	mgr := NewCookieManagerOptions(NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger}),
+		&CookieMngrOptions{AllowHTTP: true, Listeners: []EventListener{l}})
+	defer mgr.Close()
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	s = mgr.Get(r)
+	s.SetAttr("a", 1)
+
+	s2 := mgr.Regenerate(s, httptest.NewRecorder())
+	mgr.Remove(s2, httptest.NewRecorder())
+
+	eq(true, reflect.DeepEqual([]string{
+		"created:" + s.ID(),
+		"accessed:" + s.ID(),
+		"attr a <nil>->1:" + s.ID(),
+		"removed:" + s.ID(),
+		"created:" + s2.ID(),
+		"removed:" + s2.ID(),
+	}, l.take()))
+
+	// Expired client side sessions are reported when their cookies are received:
+	l2 := &recordingListener{}
+	cmgr, err := NewClientCookieManagerOptions([][]byte{make([]byte, 16)}, &ClientCookieMngrOptions{
+		AllowHTTP: true,
+		Logger:    NoopLogger,
+		Listeners: []EventListener{l2},
+	})
+	eq(nil, err)
+	s = NewSessionOptions(&SessOptions{Timeout: 10 * time.Millisecond})
+	w = httptest.NewRecorder()
+	cmgr.Add(s, w)
+	time.Sleep(20 * time.Millisecond)
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	eq(nil, cmgr.Get(r))
+	eq(true, reflect.DeepEqual([]string{"created:" + s.ID(), "expired:" + s.ID()}, l2.take()))
+}
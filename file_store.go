@@ -0,0 +1,510 @@
+/*
+
+A file system based session store implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File extension of session files.
+const sessFileExt = ".sess"
+
+// File system based session Store implementation.
+// Each session is stored in its own file, named after the session ID.
+// The modification time of a session file is set to the expiration time of the session,
+// so the session cleaner can find expired sessions without decoding the files.
+type fileStore struct {
+	dir         string             // Directory to store session files in
+	fileMode    os.FileMode        // File mode of session files
+	sessions    map[string]Session // Cache of loaded sessions (mapped from ID)
+	mux         *sync.Mutex        // mutex to synchronize access to sessions and session files
+	closeTicker chan struct{}      // Channel to signal close for the session cleaner
+	codec       Codec              // Codec to encode sessions with
+	logger      *sessLogger        // Logger of session lifecycle events and errors
+	listeners   *eventListeners    // Listeners to notify about session lifecycle events
+}
+
+// FileStoreOptions defines options that may be passed when creating a new file system based Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type FileStoreOptions struct {
+	// Session cleaner check interval, default is 10 seconds.
+	SessCleanerInterval time.Duration
+
+	// File mode of the session files, default is 0600.
+	FileMode os.FileMode
+
+	// Codec to encode sessions with, default is GobCodec.
+	// Sessions encoded with other registered codecs (see RegisterCodec()) can also be decoded,
+	// so the codec may be changed without losing existing sessions.
+	Codec Codec
+
+	// Logger to log session lifecycle events (e.g. added, removed, timed out) and errors.
+	// Default is to use the global functions of the log package.
+	// To disable logging, you may use NoopLogger.
+	Logger *log.Logger
+
+	// Handler to emit structured log records of session lifecycle events and errors with (see LogEvent),
+	// default is none. If set, Logger is not used.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// To report expired sessions which are not cached, their files are loaded before they are deleted.
+	Listeners []EventListener
+}
+
+// Pointer to zero value of FileStoreOptions to be reused for efficiency.
+var zeroFileStoreOptions = new(FileStoreOptions)
+
+// NewFileStore returns a new, file system based session Store with the default options,
+// which stores sessions in the given directory.
+// Default values of options are listed in the FileStoreOptions type.
+// See NewFileStoreOptions() for details.
+func NewFileStore(dir string) (Store, error) {
+	return NewFileStoreOptions(dir, zeroFileStoreOptions)
+}
+
+// NewFileStoreOptions returns a new, file system based session Store with the specified options,
+// which stores sessions in the given directory. The directory is created if it does not exist.
+//
+// Sessions are written to disk when they are added. Sessions are loaded lazily (when first accessed),
+// and are cached in memory afterwards. When a session is accessed (Store.Get()), only the modification
+// time of its file is updated, unless the session has been modified: changes made to a session
+// (e.g. Session.SetAttr()) are persisted the next time the session is accessed, when it is saved
+// (see Saver, the Middleware saves modified sessions at the end of requests), or when the store is closed.
+//
+// Only sessions created by this package (NewSession() and NewSessionOptions()) can be stored.
+// Sessions are encoded using the codec specified in the options (GobCodec by default),
+// types of attribute values must be registered with the codec (e.g. gob.Register() for GobCodec).
+//
+// The returned Store has an automatic session cleaner which runs
+// in its own goroutine, and deletes the files of expired sessions.
+//
+// The returned Store also implements StoreCtx, which reports failures of the operations, and Saver.
+func NewFileStoreOptions(dir string, o *FileStoreOptions) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		dir:         dir,
+		fileMode:    o.FileMode,
+		sessions:    make(map[string]Session),
+		mux:         &sync.Mutex{},
+		closeTicker: make(chan struct{}),
+		logger:      newSessLogger(o.Logger, o.LogHandler, o.LogLevels),
+		codec:       o.Codec,
+		listeners:   newEventListeners(o.Listeners),
+	}
+
+	if s.fileMode == 0 {
+		s.fileMode = 0600
+	}
+	if s.codec == nil {
+		s.codec = GobCodec{}
+	}
+
+	interval := o.SessCleanerInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	go s.sessCleaner(interval)
+
+	return s, nil
+}
+
+// sessCleaner periodically checks whether sessions have timed out
+// in an endless loop. If a session has timed out, removes it.
+// This method is to be started as a new goroutine.
+func (s *fileStore) sessCleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-s.closeTicker:
+			// We are being shut down...
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			s.sweep(now)
+		}
+	}
+}
+
+// sweep removes sessions (both files and cached values) that have expired by now.
+func (s *fileStore) sweep(now time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.logger.error("Failed to list session files", err)
+		return
+	}
+
+	var removed []Session
+	defer func() {
+		for _, sess := range removed {
+			s.listeners.expired(sess)
+		}
+	}()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, sessFileExt) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // File removed in the mean time
+		}
+		if info.ModTime().After(now) {
+			continue // Not yet expired
+		}
+
+		id := strings.TrimSuffix(name, sessFileExt)
+		sess := s.sessions[id]
+		if sess != nil && !expired(sess, now) {
+			continue // Cached session was accessed, but could not be saved
+		}
+		if sess == nil && s.listeners != nil {
+			sess, _ = s.load(id) // Only needed to notify the listeners
+		}
+		if sess != nil {
+			removed = append(removed, sess)
+		}
+
+		s.logger.expired(id, sess)
+		delete(s.sessions, id)
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			s.logger.error("Failed to remove session file", err, id)
+		}
+	}
+}
+
+// path returns the path of the file of the session specified by its id.
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, id+sessFileExt)
+}
+
+// load loads the session specified by its id from its file.
+// nil session and nil error is returned if there is no file for the session.
+func (s *fileStore) load(id string) (Session, error) {
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := decodeSession(data, s.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accesses only update the modification time of the file (which is the expiration time),
+	// restore the last accessed time from it:
+	impl := sess.(*sessionImpl)
+	if t := info.ModTime().Add(-impl.TimeoutF); t.After(impl.AccessedF) {
+		impl.AccessedF = t
+	}
+	return sess, nil
+}
+
+// save writes the session to its file atomically:
+// data is written to a temporary file first which is then renamed.
+func (s *fileStore) save(sess Session) error {
+	version := sess.Version()
+	data, err := MarshalSession(sess, s.codec)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writeFile(s.path(sess.ID()), data, expiresAt(sess)); err != nil {
+		return err
+	}
+	sess.MarkSaved(version)
+	return nil
+}
+
+// touch sets the modification time of the session's file to the expiration time of the session.
+func (s *fileStore) touch(sess Session) error {
+	expires := expiresAt(sess)
+	return os.Chtimes(s.path(sess.ID()), expires, expires)
+}
+
+// writeFile atomically writes data to the named file, and sets its modification time to expires.
+func (s *fileStore) writeFile(name string, data []byte, expires time.Time) (err error) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), s.fileMode); err != nil {
+		return err
+	}
+	if err = os.Chtimes(f.Name(), expires, expires); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// GetCtx is to implement StoreCtx.GetCtx().
+func (s *fileStore) GetCtx(ctx context.Context, id string) (Session, error) {
+	if !validID(id) {
+		return nil, nil
+	}
+
+	sess, isExpired, err := s.get(id)
+	switch {
+	case isExpired:
+		s.listeners.expired(sess)
+		return nil, nil
+	case sess != nil:
+		s.logger.accessed(sess)
+		s.listeners.accessed(sess)
+	}
+	return sess, redactErr(err, id) // Errors contain the file path which contains the ID
+}
+
+// get returns the session specified by its id, loading it if it is not cached.
+// If the session has expired, it is removed, and isExpired is true.
+func (s *fileStore) get(id string) (sess Session, isExpired bool, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	sess = s.sessions[id]
+	if sess == nil {
+		if sess, err = s.load(id); sess == nil {
+			return nil, false, err
+		}
+		s.sessions[id] = sess
+	}
+	if expired(sess, time.Now()) {
+		s.logger.expired(id, sess)
+		delete(s.sessions, id)
+		os.Remove(s.path(id))
+		return sess, true, nil
+	}
+
+	sess.Access()
+	if dirty(sess) {
+		err = s.save(sess)
+	} else {
+		err = s.touch(sess)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return sess, false, nil
+}
+
+// AddCtx is to implement StoreCtx.AddCtx().
+func (s *fileStore) AddCtx(ctx context.Context, sess Session) error {
+	if err := s.add(sess); err != nil {
+		return err
+	}
+	s.listeners.added(sess)
+	return nil
+}
+
+// add saves the session, and caches it.
+func (s *fileStore) add(sess Session) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.logger.added(sess)
+	if err := s.save(sess); err != nil {
+		return err
+	}
+	s.sessions[sess.ID()] = sess
+	return nil
+}
+
+// RemoveCtx is to implement StoreCtx.RemoveCtx().
+func (s *fileStore) RemoveCtx(ctx context.Context, sess Session) error {
+	removed, err := s.remove(sess)
+	if removed {
+		s.listeners.removed(sess)
+	}
+	return err
+}
+
+// remove removes the session, both its file and its cached value.
+// removed tells if the session was in the store.
+func (s *fileStore) remove(sess Session) (removed bool, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.logger.removed(sess)
+	_, removed = s.sessions[sess.ID()]
+	delete(s.sessions, sess.ID())
+	if err := os.Remove(s.path(sess.ID())); err != nil {
+		if os.IsNotExist(err) {
+			return removed, nil
+		}
+		return removed, err
+	}
+	return true, nil
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+func (s *fileStore) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if err := s.checkLive(sess.ID()); err != nil {
+			return err
+		}
+		s.logger.regenerated(sess, sess2)
+		if err := s.save(sess2); err != nil {
+			return err
+		}
+		delete(s.sessions, sess.ID())
+		s.sessions[sess2.ID()] = sess2
+		if err := os.Remove(s.path(sess.ID())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	s.listeners.removed(sess)
+	s.listeners.created(sess2)
+	return sess2, nil
+}
+
+// checkLive returns ErrSessionNotFound if the session with the given id is not in the store or it has expired.
+// The modification time of session files is the expiration time, so files need not be loaded.
+// s.mux must be locked.
+func (s *fileStore) checkLive(id string) error {
+	now := time.Now()
+	if sess := s.sessions[id]; sess != nil {
+		if expired(sess, now) {
+			return ErrSessionNotFound
+		}
+		return nil
+	}
+	info, err := os.Stat(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	if !info.ModTime().After(now) {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Save is to implement Saver.Save().
+func (s *fileStore) Save(ctx context.Context, sess Session) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sessions[sess.ID()] == nil {
+		// Not cached: only save if its file exists, so removed sessions are not resurrected.
+		if _, err := os.Stat(s.path(sess.ID())); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if dirty(sess) {
+		return s.save(sess)
+	}
+	return s.touch(sess)
+}
+
+// Get is to implement Store.Get().
+func (s *fileStore) Get(id string) Session {
+	sess, err := s.GetCtx(context.Background(), id)
+	if err != nil {
+		s.logger.error("Failed to get session", err, id)
+		return nil
+	}
+	return sess
+}
+
+// Add is to implement Store.Add().
+func (s *fileStore) Add(sess Session) {
+	if err := s.AddCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to add session", err, sess.ID())
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *fileStore) Remove(sess Session) {
+	if err := s.RemoveCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to remove session", err, sess.ID())
+	}
+}
+
+// Close is to implement Store.Close().
+// Modified cached sessions are saved before the store is closed.
+func (s *fileStore) Close() {
+	close(s.closeTicker)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, sess := range s.sessions {
+		if !dirty(sess) {
+			continue
+		}
+		if err := s.save(sess); err != nil {
+			s.logger.error("Failed to save session", err, sess.ID())
+		}
+	}
+}
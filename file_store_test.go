@@ -0,0 +1,127 @@
+package session
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func TestFileStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{Logger: NoopLogger})
+	eq(nil, err)
+
+	eq(nil, st.Get("asdf"))
+	eq(nil, st.Get("../asdf"))
+
+	s := NewSessionOptions(&SessOptions{
+		CAttrs: map[string]interface{}{"ca": "x"},
+		Attrs:  map[string]interface{}{"a": 1},
+	})
+	st.Add(s)
+	time.Sleep(10 * time.Millisecond)
+	eq(s, st.Get(s.ID()))
+	neq(s.Accessed(), s.Created())
+
+	s.SetAttr("b", "y")
+	st.Close()
+
+	// Sessions must survive closing / reopening the store:
+	st, err = NewFileStoreOptions(dir, &FileStoreOptions{Logger: NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	eq(true, s.Created().Equal(s2.Created()))
+	eq("x", s2.CAttr("ca"))
+	eq(1, s2.Attr("a"))
+	eq("y", s2.Attr("b"))
+	eq(s.Timeout(), s2.Timeout())
+
+	s3, err := st.(Regenerator).Regenerate(context.Background(), s2)
+	eq(nil, err)
+	neq(s.ID(), s3.ID())
+	eq(nil, st.Get(s.ID()))
+	eq("y", st.Get(s3.ID()).Attr("b"))
+	_, err = os.Stat(filepath.Join(dir, s.ID()+sessFileExt))
+	eq(true, os.IsNotExist(err))
+
+	st.Remove(s3)
+	eq(nil, st.Get(s3.ID()))
+	_, err = os.Stat(filepath.Join(dir, s3.ID()+sessFileExt))
+	eq(true, os.IsNotExist(err))
+}
+
+func TestFileStoreSessCleaner(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              NoopLogger,
+	})
+	eq(nil, err)
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Timeout: 50 * time.Millisecond})
+	st.Add(s)
+	eq(s, st.Get(s.ID()))
+
+	time.Sleep(30 * time.Millisecond)
+	eq(s, st.Get(s.ID()))
+
+	time.Sleep(80 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, s.ID()+sessFileExt))
+	eq(true, os.IsNotExist(err))
+	eq(nil, st.Get(s.ID()))
+}
+
+func TestFileStoreSave(t *testing.T) {
+	st, err := NewFileStoreOptions(t.TempDir(), &FileStoreOptions{Logger: NoopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	testSaver(t, st)
+}
+
+func TestFileStoreRegenerateRevoked(t *testing.T) {
+	st, err := NewFileStoreOptions(t.TempDir(), &FileStoreOptions{Logger: NoopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	testRegenerateRevoked(t, st)
+}
+
+func TestFileStoreTouch(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	o := &FileStoreOptions{Logger: NoopLogger}
+	st, err := NewFileStoreOptions(dir, o)
+	eq(nil, err)
+
+	s := NewSessionOptions(&SessOptions{Timeout: 50 * time.Millisecond})
+	st.Add(s)
+	time.Sleep(30 * time.Millisecond)
+	eq(s, st.Get(s.ID())) // Clean session, only the file's modification time is updated
+	st.Close()
+
+	// Last accessed time must be restored from the file's modification time:
+	st, err = NewFileStoreOptions(dir, o)
+	eq(nil, err)
+	defer st.Close()
+	time.Sleep(30 * time.Millisecond)
+	neq(nil, st.Get(s.ID()))
+}
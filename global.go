@@ -33,6 +33,13 @@ func Remove(sess Session, w http.ResponseWriter) {
 	Global.Remove(sess, w)
 }
 
+// Regenerate delegates to Global.Regenerate(); changes the ID of the session, and returns the session with the new ID.
+// It should be called when the privilege level of the session changes (e.g. after login),
+// to prevent session fixation attacks. nil is returned if regeneration fails.
+func Regenerate(sess Session, w http.ResponseWriter) Session {
+	return Global.Regenerate(sess, w)
+}
+
 // Close delegates to Global.Close(); closes the session manager, releasing any resources that were allocated.
 func Close() {
 	Global.Close()
@@ -0,0 +1,270 @@
+/*
+
+A header (e.g. bearer token) based session Manager implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// HeaderManager is a header based session Manager implementation, for clients that cannot rely on cookies
+// (e.g. mobile apps, CLI tools).
+// The session ID is read from a request header (e.g. "Authorization: Bearer <id>" or "X-Session-Id: <id>"),
+// and is sent to the clients in a response header. Clients are responsible to store the session ID
+// and to send it in subsequent requests.
+// HeaderManager also implements ManagerCtx.
+type HeaderManager struct {
+	store    Store    // Backing Store
+	storeCtx StoreCtx // Backing Store as a StoreCtx
+
+	headerName         string // Name of the request header holding the session ID
+	scheme             string // Scheme preceding the session ID in header values, may be empty
+	responseHeaderName string // Name of the response header to send the session ID in
+
+	listeners *eventListeners // Listeners to notify about session lifecycle events
+	logger    *sessLogger     // Logger of session lifecycle events
+	limiter   *sessLimiter    // Limiter of concurrent sessions per principal, may be nil
+}
+
+// HeaderMngrOptions defines options that may be passed when creating a new HeaderManager.
+// All fields are optional; default value will be used for any field that has the zero value.
+type HeaderMngrOptions struct {
+	// Name of the request header holding the session ID; default value is "Authorization"
+	HeaderName string
+
+	// Scheme preceding the session ID in header values, separated by a space (e.g. "Bearer").
+	// Default value is "Bearer" if HeaderName is "Authorization", else no scheme is used
+	// (the header value is the session ID).
+	Scheme string
+
+	// Name of the response header to send the session ID in; default value is HeaderName.
+	// The value of the response header has the same format as the request header.
+	ResponseHeaderName string
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// The manager can only report events it takes part in: sessions expiring in the backing store
+	// are not reported, register listeners on the store for that.
+	Listeners []EventListener
+
+	// Handler to emit structured log records of session lifecycle events with (see LogEvent), default is none.
+	// The manager can only log events it takes part in, like the listeners (see Listeners);
+	// session IDs rejected by the manager are logged too.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Max number of concurrent sessions per principal (e.g. user) and the policy to enforce it,
+	// default is no limit. The backing store must be indexed, see SessionLimit.
+	// If a new session is rejected, Add() does not add it (and sets no session ID in the response),
+	// it only logs the rejection with error level; AddCtx() reports ErrSessionLimit.
+	SessionLimit SessionLimit
+}
+
+// Pointer to zero value of HeaderMngrOptions to be reused for efficiency.
+var zeroHeaderMngrOptions = new(HeaderMngrOptions)
+
+// NewHeaderManager creates a new, header based session Manager with default options.
+// Default values of options are listed in the HeaderMngrOptions type.
+func NewHeaderManager(store Store) Manager {
+	return NewHeaderManagerOptions(store, zeroHeaderMngrOptions)
+}
+
+// NewHeaderManagerOptions creates a new, header based session Manager with the specified options.
+// To use a StoreCtx as the backing store, adapt it using NewStoreAdapter().
+//
+// NewHeaderManagerOptions panics if the options are invalid (see HeaderMngrOptions.Validate()).
+func NewHeaderManagerOptions(store Store, o *HeaderMngrOptions) Manager {
+	m := &HeaderManager{
+		store:              store,
+		storeCtx:           NewStoreCtxAdapter(store),
+		headerName:         http.CanonicalHeaderKey(o.HeaderName),
+		scheme:             o.Scheme,
+		responseHeaderName: http.CanonicalHeaderKey(o.ResponseHeaderName),
+		listeners:          newEventListeners(o.Listeners),
+		logger:             newSlogLogger(o.LogHandler, o.LogLevels),
+	}
+
+	if m.headerName == "" {
+		m.headerName = "Authorization"
+	}
+	if m.scheme == "" && m.headerName == "Authorization" {
+		m.scheme = "Bearer"
+	}
+	if m.responseHeaderName == "" {
+		m.responseHeaderName = m.headerName
+	}
+	if err := o.Validate(store); err != nil {
+		panic(err)
+	}
+	m.limiter, _ = newSessLimiter(o.SessionLimit, store)
+
+	return m
+}
+
+// Validate checks if the options are valid for creating a HeaderManager with the given backing store
+// (see NewHeaderManagerOptions()). The options are invalid if a session limit is set but the store is not indexed.
+func (o *HeaderMngrOptions) Validate(store Store) error {
+	_, err := newSessLimiter(o.SessionLimit, store)
+	return err
+}
+
+// Get is to implement Manager.Get().
+func (m *HeaderManager) Get(r *http.Request) Session {
+	id, ok := m.sessID(r)
+	if !ok {
+		return nil
+	}
+
+	sess := m.store.Get(id)
+	if sess != nil {
+		m.logger.accessed(sess)
+		m.listeners.accessed(sess)
+	}
+	return sess
+}
+
+// Add is to implement Manager.Add().
+func (m *HeaderManager) Add(sess Session, w http.ResponseWriter) {
+	if m.limiter != nil {
+		if err := m.AddCtx(context.Background(), sess, w); err != nil {
+			logAddFailure(m.logger, sess, err)
+		}
+		return
+	}
+	m.setHeader(sess, w)
+	m.store.Add(sess)
+	m.logger.added(sess)
+	m.listeners.added(sess)
+}
+
+// Remove is to implement Manager.Remove().
+func (m *HeaderManager) Remove(sess Session, w http.ResponseWriter) {
+	m.clearHeader(w)
+	m.store.Remove(sess)
+	m.logger.removed(sess)
+	m.listeners.removed(sess)
+}
+
+// Regenerate is to implement Manager.Regenerate().
+func (m *HeaderManager) Regenerate(sess Session, w http.ResponseWriter) Session {
+	sess2, err := m.RegenerateCtx(context.Background(), sess, w)
+	if err != nil {
+		return nil
+	}
+	return sess2
+}
+
+// GetCtx is to implement ManagerCtx.GetCtx().
+func (m *HeaderManager) GetCtx(r *http.Request) (Session, error) {
+	id, ok := m.sessID(r)
+	if !ok {
+		return nil, nil
+	}
+
+	sess, err := m.storeCtx.GetCtx(r.Context(), id)
+	if sess != nil {
+		m.logger.accessed(sess)
+		m.listeners.accessed(sess)
+	}
+	return sess, redactErr(err, id)
+}
+
+// AddCtx is to implement ManagerCtx.AddCtx().
+func (m *HeaderManager) AddCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	if err := addLimited(ctx, m.limiter, m.storeCtx, sess, m.logger, m.listeners); err != nil {
+		return err
+	}
+	m.setHeader(sess, w)
+	m.logger.added(sess)
+	m.listeners.added(sess)
+	return nil
+}
+
+// RemoveCtx is to implement ManagerCtx.RemoveCtx().
+func (m *HeaderManager) RemoveCtx(ctx context.Context, sess Session, w http.ResponseWriter) error {
+	m.clearHeader(w)
+	if err := m.storeCtx.RemoveCtx(ctx, sess); err != nil {
+		return err
+	}
+	m.logger.removed(sess)
+	m.listeners.removed(sess)
+	return nil
+}
+
+// RegenerateCtx is to implement ManagerCtx.RegenerateCtx().
+func (m *HeaderManager) RegenerateCtx(ctx context.Context, sess Session, w http.ResponseWriter) (Session, error) {
+	if sess2, ok := addLazy(sess); ok {
+		return sess2, nil
+	}
+	sess2, err := regenerate(ctx, m.storeCtx, sess)
+	if err != nil {
+		return nil, err
+	}
+	setSuccessor(sess, sess2) // So the Middleware saves the new session
+	m.setHeader(sess2, w)
+	m.logger.regenerated(sess, sess2)
+	m.listeners.removed(sess)
+	m.listeners.created(sess2)
+	return sess2, nil
+}
+
+// Save is to implement Saver.Save().
+// It saves the session in the backing store if the store implements Saver.
+func (m *HeaderManager) Save(ctx context.Context, sess Session) error {
+	return save(ctx, m.storeCtx, sess)
+}
+
+// Close is to implement Manager.Close().
+func (m *HeaderManager) Close() {
+	m.store.Close()
+}
+
+// sessID returns the session ID from the session ID header of the request.
+// ok is false if there is no session ID header, or it does not have the expected scheme.
+func (m *HeaderManager) sessID(r *http.Request) (id string, ok bool) {
+	v := strings.TrimSpace(r.Header.Get(m.headerName))
+	if m.scheme != "" {
+		if len(v) <= len(m.scheme) || !strings.EqualFold(v[:len(m.scheme)], m.scheme) || v[len(m.scheme)] != ' ' {
+			return "", false
+		}
+		v = strings.TrimSpace(v[len(m.scheme):])
+	}
+	return v, v != ""
+}
+
+// setHeader sets the session ID header of the session in the HTTP response.
+func (m *HeaderManager) setHeader(sess Session, w http.ResponseWriter) {
+	v := sess.ID()
+	if m.scheme != "" {
+		v = m.scheme + " " + v
+	}
+	w.Header().Set(m.responseHeaderName, v)
+}
+
+// clearHeader sets the session ID header in the HTTP response to empty,
+// to let the client know it should discard the session ID.
+func (m *HeaderManager) clearHeader(w http.ResponseWriter) {
+	w.Header().Set(m.responseHeaderName, "")
+}
+
+// HeaderName returns the name of the request header holding the session ID.
+func (m *HeaderManager) HeaderName() string {
+	return m.headerName
+}
+
+// Scheme returns the scheme preceding the session ID in header values.
+func (m *HeaderManager) Scheme() string {
+	return m.scheme
+}
+
+// ResponseHeaderName returns the name of the response header the session ID is sent in.
+func (m *HeaderManager) ResponseHeaderName() string {
+	return m.responseHeaderName
+}
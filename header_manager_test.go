@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestHeaderManager(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	mgr := NewHeaderManager(nil).(*HeaderManager)
+	eq("Authorization", mgr.HeaderName())
+	eq("Bearer", mgr.Scheme())
+	eq("Authorization", mgr.ResponseHeaderName())
+
+	mgr = NewHeaderManagerOptions(nil, &HeaderMngrOptions{HeaderName: "x-session-id"}).(*HeaderManager)
+	eq("X-Session-Id", mgr.HeaderName())
+	eq("", mgr.Scheme())
+	eq("X-Session-Id", mgr.ResponseHeaderName())
+}
+
+func TestHeaderManagerBearer(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewHeaderManager(st)
+	defer mgr.Close()
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+	eq("Bearer "+s.ID(), w.Header().Get("Authorization"))
+
+	for _, v := range []string{"Bearer " + s.ID(), "bearer " + s.ID(), " Bearer  " + s.ID() + " "} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", v)
+		eq(s, mgr.Get(r))
+	}
+	for _, v := range []string{"", s.ID(), "Basic " + s.ID(), "Bearer", "Bearer" + s.ID()} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", v)
+		eq(nil, mgr.Get(r))
+	}
+
+	w = httptest.NewRecorder()
+	s2 := mgr.Regenerate(s, w)
+	neq(nil, s2)
+	eq("Bearer "+s2.ID(), w.Header().Get("Authorization"))
+	eq(nil, st.Get(s.ID()))
+
+	w = httptest.NewRecorder()
+	mgr.Remove(s2, w)
+	eq(1, len(w.Header().Values("Authorization")))
+	eq("", w.Header().Get("Authorization"))
+	eq(nil, st.Get(s2.ID()))
+}
+
+func TestHeaderManagerCtx(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewHeaderManagerOptions(st, &HeaderMngrOptions{
+		HeaderName:         "X-Session-Id",
+		ResponseHeaderName: "X-New-Session-Id",
+	}).(ManagerCtx)
+	defer mgr.Close()
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	eq(nil, mgr.AddCtx(context.Background(), s, w))
+	eq(s.ID(), w.Header().Get("X-New-Session-Id"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session-Id", s.ID())
+	got, err := mgr.GetCtx(r)
+	eq(nil, err)
+	eq(s, got)
+
+	// Store failures must be reported, and no header must be set on failed add:
+	mgr2 := NewHeaderManager(NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{Logger: NoopLogger})).(ManagerCtx)
+	w = httptest.NewRecorder()
+	eq(errTestStore, mgr2.AddCtx(context.Background(), s, w))
+	eq(0, len(w.Header()))
+}
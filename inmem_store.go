@@ -7,20 +7,187 @@ An in-memory session store implementation.
 package session
 
 import (
-	"fmt"
+	"container/heap"
+	"context"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // In-memory session Store implementation.
 type inMemStore struct {
-	sessions    map[string]Session     // Map of sessions (mapped from ID)
-	mux         *sync.RWMutex          // mutex to synchronize access to sessions
-	ticker      *time.Ticker           // Ticker for the session cleaner
-	closeTicker chan struct{}          // Channel to signal close for the session cleaner
-	logPrintln  func(v ...interface{}) // Function used to log session lifecycle events (e.g. added, removed, timed out).
+	sessions    map[string]Session // Map of sessions (mapped from ID)
+	mux         *sync.RWMutex      // mutex to synchronize access to sessions
+	ticker      *time.Ticker       // Ticker for the session cleaner
+	closeTicker chan struct{}      // Channel to signal close for the session cleaner
+	logger      *sessLogger        // Logger of session lifecycle events and errors
+	listeners   *eventListeners    // Listeners to notify about session lifecycle events
+
+	indexCAttr string                              // Name of the constant attribute sessions are indexed by, may be empty
+	index      map[interface{}]map[string]struct{} // IDs of sessions, mapped from the value of their indexed constant attribute
+
+	bound  *storeBound          // Bounds of the store, nil if the store is unbounded
+	lru    lruHeap              // LRU entries of sessions, the least recently accessed one on top
+	lruEnt map[string]*lruEntry // LRU entries, mapped from session ID; nil if the store is unbounded
+	clock  atomic.Uint64        // Clock to stamp accesses of sessions with
+
+	expiry expiryHeap              // Expiry entries of sessions, the one due first on top
+	expEnt map[string]*expiryEntry // Expiry entries, mapped from session ID
+
+	codec    Codec         // Codec to encode sessions of snapshots with
+	snapshot *snapshotFile // Snapshot file, nil if snapshots are disabled
+	journal  *journal      // Journal of changes, nil if journaling is disabled
+}
+
+// storeBound holds the bounds of an in-memory store (or a shard of it) and its usage.
+type storeBound struct {
+	maxSessions int64        // Max number of sessions, 0 means no limit
+	maxBytes    int64        // Approximate max total size of sessions, 0 means no limit
+	sessions    atomic.Int64 // Number of sessions
+	bytes       atomic.Int64 // Approximate total size of sessions
+}
+
+// newStoreBound returns the bounds of a store with the given options, nil if the store is unbounded.
+func newStoreBound(o *InMemStoreOptions) *storeBound {
+	if o.MaxSessions <= 0 && o.MaxBytes <= 0 {
+		return nil
+	}
+	return &storeBound{maxSessions: int64(o.MaxSessions), maxBytes: o.MaxBytes}
+}
+
+// newShardBound returns the bounds of the i-th of n shards of a store with the given options,
+// nil if the store is unbounded. The bounds of the store are divided evenly among its shards.
+func newShardBound(o *InMemStoreOptions, i, n int) *storeBound {
+	b := newStoreBound(o)
+	if b == nil {
+		return nil
+	}
+	share := func(max int64) int64 {
+		if max <= 0 {
+			return 0 // No limit
+		}
+		sh := max / int64(n)
+		if int64(i) < max%int64(n) {
+			sh++
+		}
+		if sh == 0 {
+			sh = 1
+		}
+		return sh
+	}
+	b.maxSessions, b.maxBytes = share(b.maxSessions), share(b.maxBytes)
+	return b
+}
+
+// exceeded tells if the store exceeds its bounds.
+func (b *storeBound) exceeded() bool {
+	return b.maxSessions > 0 && b.sessions.Load() > b.maxSessions ||
+		b.maxBytes > 0 && b.bytes.Load() > b.maxBytes
+}
+
+// lruEntry is an element of the LRU heap of a bounded inMemStore.
+//
+// Store.Get() does not update the heap (so it only needs the read lock of the store), only the access stamp
+// of the entry. Like expiry entries, entries are corrected lazily when they get on top of the heap,
+// and are moved down if their session has been accessed since.
+type lruEntry struct {
+	sess     Session       // The session
+	size     atomic.Int64  // Approximate size of the session
+	accessed atomic.Uint64 // Stamp of the last access of the session
+	at       uint64        // Access stamp of the session when the entry was last updated
+	index    int           // Index of the entry in the heap
+}
+
+// lruHeap is a min-heap of LRU entries ordered by their access stamps, implementing heap.Interface.
+type lruHeap []*lruEntry
+
+func (h lruHeap) Len() int           { return len(h) }
+func (h lruHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+
+func (h lruHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *lruHeap) Push(x interface{}) {
+	en := x.(*lruEntry)
+	en.index = len(*h)
+	*h = append(*h, en)
+}
+
+func (h *lruHeap) Pop() interface{} {
+	old := *h
+	en := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return en
+}
+
+// expiryEntry is an element of the expiry heap of an inMemStore.
+//
+// Session.Access() does not update the heap: deadlines may only be extended by accesses,
+// so an entry is due no later than its session. Entries are corrected lazily when they become due,
+// and are moved down if their session has been accessed since.
+type expiryEntry struct {
+	sess  Session   // The session
+	at    time.Time // Deadline of the session when the entry was last updated
+	index int       // Index of the entry in the heap
+}
+
+// expiryHeap is a min-heap of expiry entries ordered by their deadlines, implementing heap.Interface.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	en := x.(*expiryEntry)
+	en.index = len(*h)
+	*h = append(*h, en)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	en := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return en
+}
+
+// storeListener is an EventListener which reports attribute changes of the sessions of an in-memory store
+// to the store, so it can journal them and update the estimated sizes of the sessions.
+type storeListener struct {
+	NoopEventListener
+	st interface {
+		attrChanged(sess Session, name string, old, new interface{})
+	} // Store whose sessions are tracked
+}
+
+// OnAttrChanged is to implement EventListener.OnAttrChanged().
+func (l *storeListener) OnAttrChanged(sess Session, name string, old, new interface{}) {
+	if l.st != nil {
+		l.st.attrChanged(sess, name, old, new)
+	}
+}
+
+// storeListeners returns the listeners of an in-memory store with the given options, which include
+// a storeListener (also returned) if a journal is configured or the store is bounded.
+func storeListeners(o *InMemStoreOptions) (*eventListeners, *storeListener) {
+	if o.JournalFile == "" && o.MaxSessions <= 0 && o.MaxBytes <= 0 {
+		return newEventListeners(o.Listeners), nil
+	}
+	sl := &storeListener{}
+	return newEventListeners(append(o.Listeners[:len(o.Listeners):len(o.Listeners)], sl)), sl
 }
 
 // NoopLogger that may be used as InMemStoreOptions.Logger to disable logging.
@@ -36,6 +203,66 @@ type InMemStoreOptions struct {
 	// Default is to use the global functions of the log package.
 	// To disable logging, you may use NoopLogger.
 	Logger *log.Logger
+
+	// Handler to emit structured log records of session lifecycle events and errors with (see LogEvent),
+	// default is none. If set, Logger is not used.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Listeners to notify about session lifecycle events, default is none.
+	Listeners []EventListener
+
+	// Name of the constant attribute to index sessions by (e.g. "UserName"), default is no index.
+	// If set, the returned Store implements IndexedStore, so sessions of a user can be listed and removed.
+	IndexCAttr string
+
+	// Max number of sessions to keep, default is no limit.
+	// When adding a session would exceed it, the least recently accessed sessions are evicted
+	// (which is logged, and reported to the listeners as removal).
+	MaxSessions int
+
+	// Approximate max total size of sessions in bytes, default is no limit.
+	// When adding a session would exceed it, the least recently accessed sessions are evicted like with MaxSessions.
+	// Sizes of sessions are estimated when they are added, and updated when their attributes are changed.
+	MaxBytes int64
+
+	// Number of shards to distribute sessions among, default is 1 (no sharding).
+	// Each shard has its own lock and is swept by the session cleaner separately, which reduces lock
+	// contention under concurrent load. MaxSessions and MaxBytes are divided evenly among the shards,
+	// each shard evicting its own least recently accessed sessions, so evictions are only approximately
+	// the least recently accessed sessions of the store. If MaxSessions is set, it caps the number of shards.
+	Shards int
+
+	// File to save snapshots of sessions to, default is none.
+	// If set, sessions are restored from the file when the store is created (sessions that have expired
+	// in the meantime are reported as expired), and a snapshot is saved when the store is closed.
+	// The returned Store implements SnapshotStore regardless of this setting.
+	SnapshotFile string
+
+	// Interval to save snapshots to SnapshotFile periodically at, default is to only save a snapshot
+	// when the store is closed.
+	SnapshotInterval time.Duration
+
+	// Codec to encode sessions of snapshots and the journal with, default is GobCodec.
+	// Types of attribute values must be registered with the codec (e.g. gob.Register() for GobCodec).
+	Codec Codec
+
+	// File to journal changes of sessions to (additions, removals, attribute changes and accesses), default is none.
+	// If set, the journal is replayed (on top of the snapshot) when the store is created, so changes
+	// since the last snapshot survive crashes too. The journal is compacted into the snapshot file in the
+	// background; if SnapshotFile is not set, JournalFile + ".snapshot" is used.
+	JournalFile string
+
+	// Policy to sync the journal to stable storage with, default is SyncAlways.
+	JournalSync SyncPolicy
+
+	// Interval to flush the journal at (and sync it, unless JournalSync is SyncNever), default is 1 second.
+	JournalSyncInterval time.Duration
+
+	// Size of the journal in bytes at which it is compacted into the snapshot file, default is 16 MB.
+	JournalCompactSize int64
 }
 
 // Pointer to zero value of InMemStoreOptions to be reused for efficiency.
@@ -52,31 +279,72 @@ func NewInMemStore() Store {
 // NewInMemStoreOptions returns a new, in-memory session Store with the specified options.
 // The returned Store has an automatic session cleaner which runs
 // in its own goroutine.
+//
+// The returned Store also implements IndexedStore, which reports ErrNotIndexed
+// unless InMemStoreOptions.IndexCAttr is set, and SnapshotStore.
 func NewInMemStoreOptions(o *InMemStoreOptions) Store {
-	s := &inMemStore{
-		sessions:    make(map[string]Session),
-		mux:         &sync.RWMutex{},
-		closeTicker: make(chan struct{}),
+	interval := o.SessCleanerInterval
+	if interval == 0 {
+		interval = 10 * time.Second
 	}
 
-	output := log.Output
-	if o.Logger != nil {
-		output = o.Logger.Output
+	shards := o.Shards
+	if o.MaxSessions > 0 && shards > o.MaxSessions {
+		shards = o.MaxSessions // Each shard must be able to hold a session
 	}
-	s.logPrintln = func(v ...interface{}) {
-		output(3, fmt.Sprintln(v...))
+	if shards > 1 {
+		return newShardedInMemStore(o, shards, interval)
 	}
 
-	interval := o.SessCleanerInterval
-	if interval == 0 {
-		interval = 10 * time.Second
+	listeners, sl := storeListeners(o)
+	s := newInMemStore(o, newStoreBound(o), newSessLogger(o.Logger, o.LogHandler, o.LogLevels), listeners)
+	if sl != nil {
+		sl.st = s
+	}
+	s.snapshot = newSnapshotFile(snapshotName(o), s, s.logger)
+	if o.JournalFile != "" {
+		s.journal = openJournal(o, s, s.snapshot, s.logger)
+	} else {
+		s.snapshot.restore()
 	}
 
 	go s.sessCleaner(interval)
+	if s.snapshot != nil && o.SnapshotInterval > 0 {
+		go s.snapshot.run(o.SnapshotInterval, s.closeTicker)
+	}
+	if s.journal != nil {
+		go s.journal.run(s.closeTicker)
+	}
 
 	return s
 }
 
+// newInMemStore returns a new inMemStore with the specified options, bounds, logger and listeners.
+// The session cleaner is not started.
+func newInMemStore(o *InMemStoreOptions, bound *storeBound, logger *sessLogger, listeners *eventListeners) *inMemStore {
+	s := &inMemStore{
+		sessions:    make(map[string]Session),
+		mux:         &sync.RWMutex{},
+		closeTicker: make(chan struct{}),
+		logger:      logger,
+		listeners:   listeners,
+		indexCAttr:  o.IndexCAttr,
+		bound:       bound,
+		expEnt:      make(map[string]*expiryEntry),
+		codec:       o.Codec,
+	}
+	if s.codec == nil {
+		s.codec = GobCodec{}
+	}
+	if s.indexCAttr != "" {
+		s.index = make(map[interface{}]map[string]struct{})
+	}
+	if s.bound != nil {
+		s.lruEnt = make(map[string]*lruEntry)
+	}
+	return s
+}
+
 // sessCleaner periodically checks whether sessions have timed out
 // in an endless loop. If a session has timed out, removes it.
 // This method is to be started as a new goroutine.
@@ -90,75 +358,428 @@ func (s *inMemStore) sessCleaner(interval time.Duration) {
 			ticker.Stop()
 			return
 		case now := <-ticker.C:
-			// Do a sweep.
-			// Remove is very rare compared to the number of checks, so:
-			// "Quick" check with read-lock to see if there's anything to remove:
-			// Note: Session.Access() is called with s.mux, the same mutex we use
-			// when looking for timed-out sessions, so we're good.
-			needRemove := func() bool {
-				s.mux.RLock() // Read lock is enough
-				defer s.mux.RUnlock()
-
-				for _, sess := range s.sessions {
-					if now.Sub(sess.Accessed()) > sess.Timeout() {
-						return true
-					}
-				}
-				return false
-			}()
-			if !needRemove {
-				continue
-			}
+			s.sweep(now)
+		}
+	}
+}
 
-			// Remove required:
-			func() {
-				s.mux.Lock() // Read-write lock required
-				defer s.mux.Unlock()
+// sweep removes the sessions that have timed out at the given time.
+// Only the sessions whose expiry entries are due are checked.
+func (s *inMemStore) sweep(now time.Time) {
+	// Remove is very rare compared to the number of checks, so:
+	// "Quick" check with read-lock to see if there's anything due:
+	needCheck := func() bool {
+		s.mux.RLock() // Read lock is enough
+		defer s.mux.RUnlock()
 
-				for _, sess := range s.sessions {
-					if now.Sub(sess.Accessed()) > sess.Timeout() {
-						s.logPrintln("Session timed out:", sess.ID())
-						delete(s.sessions, sess.ID())
-					}
-				}
-			}()
+		return len(s.expiry) > 0 && now.After(s.expiry[0].at)
+	}()
+	if !needCheck {
+		return
+	}
+
+	// Check required:
+	// Note: Session.Access() is called with s.mux, the same mutex we use
+	// when looking for timed-out sessions, so we're good.
+	var removed []Session
+	func() {
+		s.mux.Lock() // Read-write lock required
+		defer s.mux.Unlock()
+
+		for len(s.expiry) > 0 && now.After(s.expiry[0].at) {
+			en := s.expiry[0]
+			if !expired(en.sess, now) {
+				// Accessed since the entry was updated:
+				en.at = expiresAt(en.sess)
+				heap.Fix(&s.expiry, 0)
+				continue
+			}
+			s.logger.expired(en.sess.ID(), en.sess)
+			s.del(en.sess.ID())
+			removed = append(removed, en.sess)
 		}
+	}()
+	for _, sess := range removed {
+		s.listeners.expired(sess)
 	}
 }
 
 // Get is to implement Store.Get().
 func (s *inMemStore) Get(id string) Session {
-	s.mux.RLock()
-	defer s.mux.RUnlock()
+	sess := func() Session {
+		s.mux.RLock() // Read lock is enough, the LRU heap is corrected lazily
+		defer s.mux.RUnlock()
 
-	sess := s.sessions[id]
-	if sess == nil {
-		return nil
-	}
+		sess := s.sessions[id]
+		if sess == nil || expired(sess, time.Now()) {
+			return nil // Expired sessions are removed by the session cleaner
+		}
 
-	sess.Access()
+		sess.Access()
+		if en := s.lruEnt[id]; en != nil {
+			en.accessed.Store(s.clock.Add(1))
+		}
+		s.journal.access(sess)
+		return sess
+	}()
+
+	if sess != nil {
+		s.logger.accessed(sess)
+		s.listeners.accessed(sess)
+	}
 	return sess
 }
 
 // Add is to implement Store.Add().
 func (s *inMemStore) Add(sess Session) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	evicted := func() []Session {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		s.logger.added(sess)
+		s.put(sess)
+		return s.evict()
+	}()
 
-	s.logPrintln("Session added:", sess.ID())
-	s.sessions[sess.ID()] = sess
+	s.journal.commit()
+	for _, sess := range evicted {
+		s.listeners.removed(sess)
+	}
+	s.listeners.added(sess)
 }
 
 // Remove is to implement Store.Remove().
 func (s *inMemStore) Remove(sess Session) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	removed := func() bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		s.logger.removed(sess)
+		return s.del(sess.ID()) != nil
+	}()
+
+	s.journal.commit()
+	if removed {
+		s.listeners.removed(sess)
+	}
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+func (s *inMemStore) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	err = func() error {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if cur := s.sessions[sess.ID()]; cur == nil || expired(cur, time.Now()) {
+			return ErrSessionNotFound
+		}
+		s.logger.regenerated(sess, sess2)
+		s.del(sess.ID())
+		s.put(sess2)
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal.commit()
+	s.listeners.removed(sess)
+	s.listeners.created(sess2)
+	return sess2, nil
+}
+
+// put stores the session, replacing the session with the same ID if there is one.
+// s.mux must be locked.
+func (s *inMemStore) put(sess Session) {
+	id := sess.ID()
+	if old := s.sessions[id]; old != nil {
+		s.unindex(old)
+	}
+	s.sessions[id] = sess
+	s.addIndex(sess)
+	s.journal.put(sess)
+
+	if en := s.expEnt[id]; en != nil {
+		en.sess, en.at = sess, expiresAt(sess)
+		heap.Fix(&s.expiry, en.index)
+	} else {
+		en = &expiryEntry{sess: sess, at: expiresAt(sess)}
+		heap.Push(&s.expiry, en)
+		s.expEnt[id] = en
+	}
+
+	if s.lruEnt == nil {
+		return
+	}
+	size, stamp := sessSize(sess), s.clock.Add(1)
+	en := s.lruEnt[id]
+	if en != nil {
+		s.bound.bytes.Add(-en.size.Load())
+		en.sess, en.at = sess, stamp
+		heap.Fix(&s.lru, en.index)
+	} else {
+		en = &lruEntry{sess: sess, at: stamp}
+		heap.Push(&s.lru, en)
+		s.lruEnt[id] = en
+		s.bound.sessions.Add(1)
+	}
+	en.size.Store(size)
+	en.accessed.Store(stamp)
+	s.bound.bytes.Add(size)
+}
 
-	s.logPrintln("Session removed:", sess.ID())
-	delete(s.sessions, sess.ID())
+// del removes the session with the given ID, and returns it (nil if there is no such session).
+// s.mux must be locked.
+func (s *inMemStore) del(id string) Session {
+	sess := s.sessions[id]
+	if sess == nil {
+		return nil
+	}
+	s.unindex(sess)
+	delete(s.sessions, id)
+	s.journal.del(id)
+	heap.Remove(&s.expiry, s.expEnt[id].index)
+	delete(s.expEnt, id)
+
+	if en := s.lruEnt[id]; en != nil {
+		s.bound.bytes.Add(-en.size.Load())
+		s.bound.sessions.Add(-1)
+		heap.Remove(&s.lru, en.index)
+		delete(s.lruEnt, id)
+	}
+	return sess
+}
+
+// evict removes the least recently accessed sessions while the store exceeds its bounds,
+// and returns them. The most recently accessed session is never evicted.
+// s.mux must be locked.
+func (s *inMemStore) evict() (evicted []Session) {
+	if s.lruEnt == nil {
+		return nil
+	}
+	for len(s.lru) > 1 && s.bound.exceeded() {
+		evicted = append(evicted, s.evictEntry(s.lruTop()))
+	}
+	return
+}
+
+// lruTop corrects the top LRU entries until the one on top is up-to-date, and returns it
+// (nil if there are no entries). s.mux must be locked, and the store must be bounded.
+func (s *inMemStore) lruTop() *lruEntry {
+	for len(s.lru) > 0 {
+		en := s.lru[0]
+		stamp := en.accessed.Load()
+		if stamp == en.at {
+			return en
+		}
+		// Accessed since the entry was updated:
+		en.at = stamp
+		heap.Fix(&s.lru, 0)
+	}
+	return nil
+}
+
+// evictEntry removes the session of the LRU entry, and returns it.
+// s.mux must be locked.
+func (s *inMemStore) evictEntry(en *lruEntry) Session {
+	sess := s.del(en.sess.ID())
+	s.logger.evicted(sess, "capacity")
+	return sess
+}
+
+// indexKey returns the key of the session in the index.
+// ok is false if the store is not indexed or the session does not have an indexable value.
+func (s *inMemStore) indexKey(sess Session) (key interface{}, ok bool) {
+	if s.index == nil {
+		return nil, false
+	}
+	key = sess.CAttr(s.indexCAttr)
+	return key, indexable(key)
+}
+
+// addIndex adds the session to the index.
+// s.mux must be locked.
+func (s *inMemStore) addIndex(sess Session) {
+	key, ok := s.indexKey(sess)
+	if !ok {
+		return
+	}
+	ids := s.index[key]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		s.index[key] = ids
+	}
+	ids[sess.ID()] = struct{}{}
+}
+
+// unindex removes the session from the index.
+// s.mux must be locked.
+func (s *inMemStore) unindex(sess Session) {
+	key, ok := s.indexKey(sess)
+	if !ok {
+		return
+	}
+	ids := s.index[key]
+	delete(ids, sess.ID())
+	if len(ids) == 0 {
+		delete(s.index, key)
+	}
+}
+
+// IndexCAttr is to implement IndexedStore.IndexCAttr().
+func (s *inMemStore) IndexCAttr() string {
+	return s.indexCAttr
+}
+
+// IndexedSessions is to implement IndexedStore.IndexedSessions().
+func (s *inMemStore) IndexedSessions(ctx context.Context, value interface{}) ([]Session, error) {
+	if s.index == nil {
+		return nil, ErrNotIndexed
+	}
+	if !indexable(value) {
+		return nil, nil
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	now := time.Now()
+	var sessions []Session
+	for id := range s.index[value] {
+		if sess := s.sessions[id]; !expired(sess, now) {
+			sessions = append(sessions, sess)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created().Before(sessions[j].Created())
+	})
+	return sessions, nil
+}
+
+// RemoveIndexed is to implement IndexedStore.RemoveIndexed().
+func (s *inMemStore) RemoveIndexed(ctx context.Context, value interface{}) (int, error) {
+	if s.index == nil {
+		return 0, ErrNotIndexed
+	}
+	if !indexable(value) {
+		return 0, nil
+	}
+
+	var removed []Session
+	func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		for id := range s.index[value] {
+			sess := s.del(id)
+			s.logger.removed(sess)
+			removed = append(removed, sess)
+		}
+	}()
+
+	s.journal.commit()
+	for _, sess := range removed {
+		s.listeners.removed(sess)
+	}
+	return len(removed), nil
 }
 
 // Close is to implement Store.Close().
 func (s *inMemStore) Close() {
 	close(s.closeTicker)
+	saveOnClose(s.snapshot, s.journal)
+}
+
+// attrChanged journals the attribute change of the session and updates its estimated size,
+// if it is in the store.
+func (s *inMemStore) attrChanged(sess Session, name string, old, new interface{}) {
+	func() {
+		// Checking and journaling under the lock, so a concurrent removal cannot be journaled first.
+		// Read lock is enough, sizes are updated atomically.
+		s.mux.RLock()
+		defer s.mux.RUnlock()
+
+		if s.sessions[sess.ID()] != sess {
+			return
+		}
+		s.journal.put(sess)
+		if en := s.lruEnt[sess.ID()]; en != nil {
+			diff := attrSize(name, new) - attrSize(name, old)
+			en.size.Add(diff)
+			s.bound.bytes.Add(diff)
+		}
+	}()
+	s.journal.commit()
+}
+
+// sessOverhead is the approximate size of a session without its ID and attributes.
+const sessOverhead = 256
+
+// sessSize returns the approximate size of the session in bytes.
+func sessSize(sess Session) int64 {
+	size := int64(sessOverhead + len(sess.ID()))
+	for k, v := range sess.Attrs() {
+		size += attrSize(k, v)
+	}
+	if s, ok := toImpl(sess); ok {
+		for k, v := range s.CAttrsF {
+			size += attrSize(k, v)
+		}
+	}
+	return size
+}
+
+// attrSize returns the approximate size of the attribute in bytes, 0 if value is nil
+// (the attribute does not exist).
+func attrSize(name string, value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	return int64(len(name)) + approxSize(reflect.ValueOf(value), 0)
+}
+
+// approxSize returns the approximate size of the value in bytes, including the data it refers to.
+// Values deeper than 8 levels are not traversed (which also protects against cycles).
+func approxSize(v reflect.Value, depth int) int64 {
+	if !v.IsValid() {
+		return 16
+	}
+	size := int64(v.Type().Size())
+	if depth >= 8 {
+		return size
+	}
+	switch v.Kind() {
+	case reflect.String:
+		size += int64(v.Len())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			size += int64(v.Len())
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			es := approxSize(v.Index(i), depth+1)
+			if v.Kind() == reflect.Array {
+				es -= int64(v.Type().Elem().Size()) // Already included in the size of the array
+			}
+			size += es
+		}
+	case reflect.Map:
+		for it := v.MapRange(); it.Next(); {
+			size += approxSize(it.Key(), depth+1) + approxSize(it.Value(), depth+1)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			size += approxSize(v.Elem(), depth+1)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			size += approxSize(v.Field(i), depth+1) - int64(v.Field(i).Type().Size()) // Field itself is included in the size of the struct
+		}
+	}
+	return size
 }
@@ -1,8 +1,10 @@
 package session
 
 import (
+	"context"
 	"log"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -27,6 +29,51 @@ func TestInMemStore(t *testing.T) {
 	eq(nil, st.Get(s.ID()))
 }
 
+func TestInMemStoreRegenerate(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+
+	s2, err := st.(Regenerator).Regenerate(context.Background(), s)
+	eq(nil, err)
+	neq(s.ID(), s2.ID())
+	eq(nil, st.Get(s.ID()))
+	eq(s2, st.Get(s2.ID()))
+	eq(1, s2.Attr("a"))
+}
+
+func TestInMemStoreRegenerateRevoked(t *testing.T) {
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	testRegenerateRevoked(t, st)
+}
+
+func TestInMemStoreMaxLifetime(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              NoopLogger,
+	})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{MaxLifetime: 50 * time.Millisecond})
+	st.Add(s)
+
+	// Accessing the session does not extend its lifetime:
+	for i := 0; i < 4; i++ {
+		eq(s, st.Get(s.ID()))
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond)
+	eq(nil, st.Get(s.ID()))
+}
+
 func TestInMemStoreSessCleaner(t *testing.T) {
 	eq := mighty.Eq(t)
 
@@ -46,3 +93,198 @@ func TestInMemStoreSessCleaner(t *testing.T) {
 	time.Sleep(80 * time.Millisecond)
 	eq(nil, st.Get(s.ID()))
 }
+
+func TestInMemStoreIndex(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	// Not indexed:
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	_, err := st.(IndexedStore).IndexedSessions(ctx, "bob")
+	eq(ErrNotIndexed, err)
+	st.Close()
+
+	st = NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              NoopLogger,
+		IndexCAttr:          "UserName",
+	})
+	defer st.Close()
+	ist := st.(IndexedStore)
+
+	newUserSess := func(user interface{}, timeout time.Duration) Session {
+		s := NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"UserName": user}, Timeout: timeout})
+		st.Add(s)
+		return s
+	}
+	bob1 := newUserSess("bob", 0)
+	bob2 := newUserSess("bob", 0)
+	bob3 := newUserSess("bob", 20*time.Millisecond)
+	alice := newUserSess("alice", 0)
+	newUserSess([]string{"x"}, 0) // Not indexable
+	st.Add(NewSession())          // Not indexed
+
+	sessions, err := ist.IndexedSessions(ctx, "bob")
+	eq(nil, err)
+	eq(true, reflect.DeepEqual([]Session{bob1, bob2, bob3}, sessions))
+
+	// Removed, regenerated and expired sessions:
+	st.Remove(bob1)
+	bob2b, err := st.(Regenerator).Regenerate(ctx, bob2)
+	eq(nil, err)
+	time.Sleep(60 * time.Millisecond)
+	sessions, _ = ist.IndexedSessions(ctx, "bob")
+	eq(true, reflect.DeepEqual([]Session{bob2b}, sessions))
+
+	sessions, _ = ist.IndexedSessions(ctx, []string{"x"})
+	eq(0, len(sessions))
+
+	// Log out everywhere:
+	newUserSess("bob", 0)
+	n, err := ist.RemoveIndexed(ctx, "bob")
+	eq(nil, err)
+	eq(2, n)
+	eq(nil, st.Get(bob2b.ID()))
+	sessions, _ = ist.IndexedSessions(ctx, "bob")
+	eq(0, len(sessions))
+	eq(alice, st.Get(alice.ID()))
+	n, _ = ist.RemoveIndexed(ctx, "bob")
+	eq(0, n)
+}
+
+func TestInMemStoreMaxSessions(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		Logger:      NoopLogger,
+		Listeners:   []EventListener{l},
+		MaxSessions: 2,
+	})
+	defer st.Close()
+
+	s1, s2, s3 := NewSession(), NewSession(), NewSession()
+	st.Add(s1)
+	st.Add(s2)
+	st.Get(s1.ID()) // s2 becomes the least recently accessed
+	st.Add(s1)      // Saving does not evict
+	st.Add(s3)
+	eq(nil, st.Get(s2.ID()))
+	eq(s1, st.Get(s1.ID()))
+	eq(s3, st.Get(s3.ID()))
+	eq(true, reflect.DeepEqual([]string{
+		"created:" + s1.ID(),
+		"created:" + s2.ID(),
+		"accessed:" + s1.ID(),
+		"removed:" + s2.ID(),
+		"created:" + s3.ID(),
+		"accessed:" + s1.ID(),
+		"accessed:" + s3.ID(),
+	}, l.take()))
+
+	st.Remove(s1)
+	st.Add(s2)
+	eq(s2, st.Get(s2.ID()))
+	eq(s3, st.Get(s3.ID()))
+
+	// Get only needs the read lock of the store:
+	ims := st.(*inMemStore)
+	ims.mux.RLock()
+	eq(s2, st.Get(s2.ID()))
+	ims.mux.RUnlock()
+	st.Add(s1) // s3 is the least recently accessed
+	eq(nil, st.Get(s3.ID()))
+}
+
+func TestInMemStoreMaxBytes(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, MaxBytes: 3600})
+	defer st.Close()
+	ims := st.(*inMemStore)
+
+	s1, s2 := NewSession(), NewSession()
+	st.Add(s1)
+	st.Add(s2)
+	eq(sessSize(s1)+sessSize(s2), ims.bound.bytes.Load())
+
+	// Changes of sessions are accounted for (once their listeners are attached, on Add or Get):
+	s1.SetAttr("data", make([]byte, 3000))
+	eq(sessSize(s1)+sessSize(s2), ims.bound.bytes.Load())
+	eq(true, ims.bound.bytes.Load() > 3000)
+	s1.SetAttr("data", make([]byte, 2000))
+	eq(sessSize(s1)+sessSize(s2), ims.bound.bytes.Load())
+	s1.SetAttr("data", make([]byte, 3000))
+
+	s3 := NewSession()
+	st.Get(s1.ID())
+	st.Add(s3)
+	eq(nil, st.Get(s2.ID()))
+	eq(s1, st.Get(s1.ID()))
+	eq(sessSize(s1)+sessSize(s3), ims.bound.bytes.Load())
+
+	// A session exceeding the limit alone is kept:
+	s4 := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"data": make([]byte, 5000)}})
+	st.Add(s4)
+	eq(nil, st.Get(s1.ID()))
+	eq(nil, st.Get(s3.ID()))
+	eq(s4, st.Get(s4.ID()))
+	eq(sessSize(s4), ims.bound.bytes.Load())
+
+	st.Remove(s4)
+	eq(int64(0), ims.bound.bytes.Load())
+	eq(0, len(ims.lru))
+}
+
+func TestApproxSize(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	size := func(v interface{}) int64 { return approxSize(reflect.ValueOf(v), 0) }
+	eq(int64(16+5), size("hello"))
+	eq(int64(24+100), size(make([]byte, 100)))
+	eq(true, size(map[string]int{"a": 1, "b": 2}) > size(map[string]int{"a": 1}))
+	eq(true, size(&struct{ S string }{"hello"}) > size(&struct{ S string }{}))
+
+	type node struct{ next *node }
+	n := &node{}
+	n.next = n
+	eq(true, size(n) > 0) // Cycles do not cause infinite recursion
+}
+
+func TestInMemStoreExpiryHeap(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	s := newInMemStore(&InMemStoreOptions{}, nil, nil, newEventListeners([]EventListener{l}))
+
+	short := NewSessionOptions(&SessOptions{Timeout: time.Minute})
+	accessed := NewSessionOptions(&SessOptions{Timeout: time.Minute})
+	long := NewSessionOptions(&SessOptions{Timeout: time.Hour})
+	limited := NewSessionOptions(&SessOptions{Timeout: time.Hour, MaxLifetime: 2 * time.Minute})
+	for _, sess := range []Session{long, short, accessed, limited} {
+		s.Add(sess)
+	}
+	eq(4, s.expiry.Len())
+	eq(short, s.expiry[0].sess)
+	l.take()
+
+	// Accesses do not update the heap, the entry is corrected when it is due:
+	accessed.(*sessionImpl).AccessedF = time.Now().Add(time.Minute)
+	s.sweep(time.Now().Add(90 * time.Second))
+	eq(true, reflect.DeepEqual([]string{"expired:" + short.ID()}, l.take()))
+	eq(3, s.expiry.Len())
+	eq(expiresAt(accessed), s.expEnt[accessed.ID()].at)
+
+	s.sweep(time.Now().Add(150 * time.Second))
+	eq(true, reflect.DeepEqual([]string{"expired:" + limited.ID(), "expired:" + accessed.ID()}, l.take()))
+	eq(long, s.expiry[0].sess)
+
+	// Nothing due:
+	s.sweep(time.Now().Add(30 * time.Minute))
+	eq(0, len(l.take()))
+	eq(long, s.Get(long.ID()))
+
+	s.Remove(long)
+	eq(0, s.expiry.Len())
+	eq(0, len(s.expEnt))
+}
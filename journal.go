@@ -0,0 +1,420 @@
+/*
+
+Write-ahead journal of the in-memory session store.
+
+*/
+
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy tells when the journal of the in-memory store is synced to stable storage (fsync).
+// See InMemStoreOptions.JournalFile.
+type SyncPolicy int
+
+// Sync policies.
+const (
+	// SyncAlways syncs the journal before Add, Remove and attribute changes return.
+	// Accesses of sessions are synced with the next sync.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs the journal periodically (see InMemStoreOptions.JournalSyncInterval),
+	// operations of the last interval may be lost on a crash of the machine.
+	SyncInterval
+
+	// SyncNever leaves syncing to the operating system, the journal is only flushed.
+	SyncNever
+)
+
+// journalHeader starts journal files, the last byte being the version of the format.
+//
+// The header is followed by records: an operation byte, the length of the payload as an uvarint, and the payload.
+// A truncated last record (e.g. due to a crash) is discarded when the journal is replayed.
+const journalHeader = "SESSJNL\x01"
+
+// Journal operations.
+const (
+	journalPut    = 'p' // Session added or changed, payload is the session marshaled with MarshalSession()
+	journalDel    = 'd' // Session removed, payload is its ID
+	journalAccess = 'a' // Session accessed, payload is the access time (Unix nanoseconds, 8 bytes big endian) and the ID
+)
+
+// journal is an append-only log of the changes of the sessions of an in-memory store,
+// which is replayed when the store is created, and is compacted into a snapshot in the background.
+// Methods may be called on a nil value, which means journaling is disabled.
+type journal struct {
+	name         string        // Name of the journal file
+	policy       SyncPolicy    // Sync policy
+	syncInterval time.Duration // Interval of periodic syncs
+	compactSize  int64         // Size of records after which the journal is compacted
+	codec        Codec         // Codec to encode sessions with
+	snapshot     *snapshotFile // Snapshot file the journal is compacted into
+	logger       *sessLogger   // Logger to log errors with
+
+	mux       sync.Mutex    // Mutex to synchronize access to the journal file
+	f         *os.File      // Journal file, nil if it could not be opened
+	w         *bufio.Writer // Buffered writer of f
+	size      int64         // Size of the journal file
+	compactAt int64         // Size at which compaction is requested
+	compactCh chan struct{} // Channel to request compaction
+
+	cmux sync.Mutex // Mutex to serialize compactions
+}
+
+// openJournal restores the sessions of st from the snapshot file and the journal (and the
+// journal being compacted, if compaction was interrupted), then opens the journal for appending.
+// It returns nil if o.JournalFile is empty.
+func openJournal(o *InMemStoreOptions, st snapshotStore, snapshot *snapshotFile, logger *sessLogger) *journal {
+	if o.JournalFile == "" {
+		return nil
+	}
+
+	j := &journal{
+		name:         o.JournalFile,
+		policy:       o.JournalSync,
+		syncInterval: o.JournalSyncInterval,
+		compactSize:  o.JournalCompactSize,
+		codec:        o.Codec,
+		snapshot:     snapshot,
+		logger:       logger,
+		compactCh:    make(chan struct{}, 1),
+	}
+	if j.syncInterval == 0 {
+		j.syncInterval = time.Second
+	}
+	if j.compactSize == 0 {
+		j.compactSize = 16 << 20
+	}
+	if j.codec == nil {
+		j.codec = GobCodec{}
+	}
+
+	sessions := map[string]Session{}
+	ss, err := snapshot.load()
+	if err != nil {
+		logger.error("Failed to restore snapshot", err)
+	}
+	for _, sess := range ss {
+		sessions[sess.ID()] = sess
+	}
+	j.replay(j.name+".old", sessions)
+	valid := j.replay(j.name, sessions)
+
+	restored := make([]Session, 0, len(sessions))
+	for _, sess := range sessions {
+		restored = append(restored, sess)
+	}
+	st.restore(restored)
+
+	if valid < 0 {
+		return j // Not a journal, it must not be overwritten
+	}
+	if err := j.open(valid); err != nil {
+		logger.error("Failed to open journal", err)
+	}
+	return j
+}
+
+// snapshotName returns the name of the snapshot file of a store with the given options.
+func snapshotName(o *InMemStoreOptions) string {
+	if o.SnapshotFile == "" && o.JournalFile != "" {
+		return o.JournalFile + ".snapshot"
+	}
+	return o.SnapshotFile
+}
+
+// saveOnClose saves the sessions of a store being closed: if the store has a journal,
+// it is compacted into the snapshot file and closed, else a snapshot is saved.
+func saveOnClose(snapshot *snapshotFile, j *journal) {
+	if j == nil {
+		snapshot.save()
+		return
+	}
+	j.compact()
+	j.close()
+}
+
+// replay applies the records of the named journal file to sessions, and returns the size of its valid part
+// (0 if the file does not exist, -1 if it is not a journal). Records that cannot be decoded are skipped.
+func (j *journal) replay(name string, sessions map[string]Session) (valid int64) {
+	f, err := os.Open(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			j.logger.error("Failed to replay journal", err)
+		}
+		return 0
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(journalHeader))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != journalHeader {
+		j.logger.error("Failed to replay journal", errors.New("session: invalid journal header"))
+		return -1
+	}
+	valid = int64(len(journalHeader))
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return // End of journal
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > maxSnapshotRecord {
+			return // Truncated record
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return // Truncated record
+		}
+		valid += 1 + int64(uvarintLen(size)) + int64(size)
+
+		switch op {
+		case journalPut:
+			sess, err := UnmarshalSession(payload)
+			if err != nil {
+				j.logger.error("Failed to replay journal record", err)
+				continue
+			}
+			sessions[sess.ID()] = sess
+		case journalDel:
+			delete(sessions, string(payload))
+		case journalAccess:
+			if len(payload) < 8 {
+				continue
+			}
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+			if s, ok := toImpl(sessions[string(payload[8:])]); ok && t.After(s.AccessedF) {
+				s.AccessedF = t
+			}
+		}
+	}
+}
+
+// uvarintLen returns the length of the uvarint encoding of x.
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// open opens the journal file for appending, truncating it to its valid part of the given size
+// (0 meaning the file has to be recreated).
+func (j *journal) open(valid int64) error {
+	flag := os.O_RDWR | os.O_CREATE
+	if valid == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(j.name, flag, 0600)
+	if err != nil {
+		return err
+	}
+	if valid == 0 {
+		if _, err := f.WriteString(journalHeader); err != nil {
+			f.Close()
+			return err
+		}
+		valid = int64(len(journalHeader))
+	} else if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f, j.w, j.size = f, bufio.NewWriter(f), valid
+	j.compactAt = j.size + j.compactSize
+	return nil
+}
+
+// append appends a record to the journal.
+// j.mux must be locked.
+func (j *journal) append(op byte, payload ...[]byte) {
+	if j.w == nil {
+		return
+	}
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = op
+	n := 1 + binary.PutUvarint(buf[1:], uint64(size))
+	j.w.Write(buf[:n])
+	for _, p := range payload {
+		j.w.Write(p)
+	}
+	j.size += int64(n + size)
+
+	if j.size >= j.compactAt {
+		j.compactAt = j.size + j.compactSize // Do not request again until it grows again
+		select {
+		case j.compactCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// put journals that the session was added or changed.
+//
+// The session is marshaled holding j.mux, so records are appended in the order their states were
+// captured: the last record of a session always holds its latest state, even if concurrent changes
+// are reported in a different order.
+func (j *journal) put(sess Session) {
+	if j == nil {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	data, err := MarshalSession(sess, j.codec)
+	if err != nil {
+		j.logger.error("Failed to write journal", err, sess.ID())
+		return
+	}
+	j.append(journalPut, data)
+}
+
+// del journals that the session with the given ID was removed.
+func (j *journal) del(id string) {
+	if j == nil {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.append(journalDel, []byte(id))
+}
+
+// access journals that the session was accessed.
+func (j *journal) access(sess Session) {
+	if j == nil {
+		return
+	}
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(sess.Accessed().UnixNano()))
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.append(journalAccess, t[:], []byte(sess.ID()))
+}
+
+// commit flushes the journal after an operation, and syncs it if the policy is SyncAlways.
+func (j *journal) commit() {
+	if j == nil {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	j.flush(j.policy == SyncAlways)
+}
+
+// flush flushes the journal, and syncs it if sync is true.
+// j.mux must be locked.
+func (j *journal) flush(sync bool) {
+	if j.w == nil {
+		return
+	}
+	err := j.w.Flush()
+	if err == nil && sync {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		j.logger.error("Failed to write journal", err)
+	}
+}
+
+// run periodically flushes (and syncs, depending on the policy) the journal, and compacts it when requested,
+// until done is closed.
+// This method is to be started as a new goroutine.
+func (j *journal) run(done <-chan struct{}) {
+	ticker := time.NewTicker(j.syncInterval)
+
+	for {
+		select {
+		case <-done:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			j.mux.Lock()
+			j.flush(j.policy != SyncNever)
+			j.mux.Unlock()
+		case <-j.compactCh:
+			j.compact()
+		}
+	}
+}
+
+// compact compacts the journal into the snapshot file: the journal is moved aside (to the ".old" file)
+// and a new journal is started, then a snapshot is saved and the old journal is removed.
+// If saving the snapshot fails, the old journal is kept (and replayed on restart), and the next
+// compaction retries saving the snapshot.
+func (j *journal) compact() {
+	if j == nil {
+		return
+	}
+	j.cmux.Lock()
+	defer j.cmux.Unlock()
+
+	old := j.name + ".old"
+	if _, err := os.Stat(old); os.IsNotExist(err) {
+		if err := j.rotate(old); err != nil {
+			j.logger.error("Failed to compact journal", err)
+			return
+		}
+	}
+	if err := j.snapshot.save(); err != nil {
+		return // Already logged
+	}
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		j.logger.error("Failed to compact journal", err)
+	}
+}
+
+// rotate renames the journal file to old, and starts a new journal file.
+func (j *journal) rotate(old string) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.f == nil {
+		return errors.New("session: journal is not open")
+	}
+	j.flush(true)
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	j.f, j.w = nil, nil
+	if err := os.Rename(j.name, old); err != nil {
+		if err2 := j.open(j.size); err2 != nil {
+			j.logger.error("Failed to open journal", err2)
+		}
+		return err
+	}
+	return j.open(0)
+}
+
+// close flushes, syncs and closes the journal file.
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.f == nil {
+		return
+	}
+	j.flush(true)
+	if err := j.f.Close(); err != nil {
+		j.logger.error("Failed to close journal", err)
+	}
+	j.f, j.w = nil, nil
+}
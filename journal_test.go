@@ -0,0 +1,194 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// crashCopy copies the files of the journaled store in dir to a new directory as if the process crashed,
+// and returns the options to open the copy with.
+func crashCopy(t *testing.T, dir string, o *InMemStoreOptions) *InMemStoreOptions {
+	dir2 := t.TempDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir2, e.Name()), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o2 := *o
+	o2.JournalFile = filepath.Join(dir2, filepath.Base(o.JournalFile))
+	return &o2
+}
+
+func TestJournal(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	o := &InMemStoreOptions{Logger: NoopLogger, JournalFile: filepath.Join(dir, "sessions.journal")}
+	st := NewInMemStoreOptions(o)
+	defer func() { st.Close() }()
+
+	s1, s2, s3 := NewSession(), NewSession(), NewSession()
+	st.Add(s1)
+	st.Add(s2)
+	st.Add(s3)
+	st.Remove(s2)
+	s1.SetAttr("a", 1)
+	s2.SetAttr("a", 2) // Not in the store, must not be restored
+	s3b := st.Get(s3.ID())
+	s3b.SetAttr("b", 3)
+
+	// Journaled changes survive a crash:
+	o2 := crashCopy(t, dir, o)
+	st2 := NewInMemStoreOptions(o2)
+	r1 := st2.Get(s1.ID())
+	neq(nil, r1)
+	eq(1, r1.Attr("a"))
+	eq(nil, st2.Get(s2.ID()))
+	eq(3, st2.Get(s3.ID()).Attr("b"))
+	st2.Close()
+
+	// Truncated last record is discarded:
+	o3 := crashCopy(t, dir, o)
+	f, err := os.OpenFile(o3.JournalFile, os.O_APPEND|os.O_WRONLY, 0)
+	eq(nil, err)
+	f.Write([]byte{journalPut, 100, 1, 2})
+	f.Close()
+	info, _ := os.Stat(o3.JournalFile)
+	st3 := NewInMemStoreOptions(o3)
+	eq(1, st3.Get(s1.ID()).Attr("a"))
+	info2, _ := os.Stat(o3.JournalFile)
+	eq(info.Size()-4, info2.Size())
+	st3.Close()
+
+	// Closing compacts the journal into the snapshot:
+	st.Close()
+	info, _ = os.Stat(o.JournalFile)
+	eq(int64(len(journalHeader)), info.Size())
+	_, err = os.Stat(o.JournalFile + ".snapshot")
+	eq(nil, err)
+	st = NewInMemStoreOptions(o)
+	eq(1, st.Get(s1.ID()).Attr("a"))
+	eq(3, st.Get(s3.ID()).Attr("b"))
+}
+
+func TestJournalCompaction(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	dir := t.TempDir()
+	o := &InMemStoreOptions{
+		Logger:             NoopLogger,
+		JournalFile:        filepath.Join(dir, "sessions.journal"),
+		JournalSync:        SyncNever,
+		JournalCompactSize: 1000,
+		Shards:             4,
+	}
+	st := NewInMemStoreOptions(o)
+	defer st.Close()
+
+	var sessions []Session
+	for i := 0; i < 20; i++ {
+		s := NewSession()
+		st.Add(s)
+		sessions = append(sessions, s)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	info, err := os.Stat(o.JournalFile)
+	eq(nil, err)
+	eq(true, info.Size() < 1000)
+	_, err = os.Stat(o.JournalFile + ".old")
+	eq(true, os.IsNotExist(err))
+
+	st2 := NewInMemStoreOptions(crashCopy(t, dir, o))
+	defer st2.Close()
+	for _, s := range sessions {
+		neq(nil, st2.Get(s.ID()))
+	}
+}
+
+func TestJournalExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	o := &InMemStoreOptions{Logger: NoopLogger, JournalFile: filepath.Join(dir, "sessions.journal")}
+	st := NewInMemStoreOptions(o)
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(s)
+	time.Sleep(40 * time.Millisecond)
+
+	// Sessions that expired while the process was down are reported:
+	l := &recordingListener{}
+	o2 := crashCopy(t, dir, o)
+	o2.Listeners = []EventListener{l}
+	st2 := NewInMemStoreOptions(o2)
+	defer st2.Close()
+	eq(true, reflect.DeepEqual([]string{"expired:" + s.ID()}, l.take()))
+	eq(nil, st2.Get(s.ID()))
+}
+
+// gateCodec is a GobCodec which blocks the first marshaling of a session whose "a" attribute is 1,
+// signaling entered and waiting for release.
+type gateCodec struct {
+	GobCodec
+	blocked          atomic.Bool
+	entered, release chan struct{}
+}
+
+func (c *gateCodec) Marshal(d *SessionData) ([]byte, error) {
+	if d.Attrs["a"] == 1 && c.blocked.CompareAndSwap(false, true) {
+		close(c.entered)
+		<-c.release
+	}
+	return c.GobCodec.Marshal(d)
+}
+
+func TestJournalConcurrentChanges(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	codec := &gateCodec{entered: make(chan struct{}), release: make(chan struct{})}
+	o := &InMemStoreOptions{Logger: NoopLogger, JournalFile: filepath.Join(dir, "sessions.journal"), Codec: codec}
+	st := NewInMemStoreOptions(o)
+	defer st.Close()
+
+	s := NewSession()
+	st.Add(s)
+
+	// The record of the first change is being marshaled when the second change happens:
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.SetAttr("a", 1)
+	}()
+	<-codec.entered
+	go func() {
+		defer wg.Done()
+		s.SetAttr("b", 2)
+	}()
+	time.Sleep(20 * time.Millisecond) // Give the second change time to be journaled (if it could be)
+	close(codec.release)
+	wg.Wait()
+
+	// The last record must hold both changes:
+	st2 := NewInMemStoreOptions(crashCopy(t, dir, o))
+	defer st2.Close()
+	eq(true, reflect.DeepEqual(map[string]interface{}{"a": 1, "b": 2}, st2.Get(s.ID()).Attrs()))
+}
@@ -0,0 +1,151 @@
+/*
+
+Limiting the number of concurrent sessions per principal.
+
+*/
+
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+// ErrSessionLimit is returned by ManagerCtx.AddCtx() if adding a new session would exceed
+// the session limit of its principal, and the limit policy is LimitReject.
+var ErrSessionLimit = errors.New("session: session limit exceeded")
+
+// LimitPolicy tells what to do when adding a new session would exceed the session limit of its principal.
+type LimitPolicy int
+
+// Limit policies.
+const (
+	// LimitReject rejects the new session.
+	LimitReject LimitPolicy = iota
+
+	// LimitEvictLRU removes the least recently accessed sessions of the principal to make room for the new one.
+	LimitEvictLRU
+)
+
+// SessionLimit defines the max number of concurrent sessions per principal (e.g. user) of a Manager.
+//
+// Principals are identified by the constant attribute the backing store is indexed by,
+// so the store must implement IndexedStore with an index configured (e.g. InMemStoreOptions.IndexCAttr).
+// Sessions not having an indexable value for that attribute (e.g. anonymous sessions) are not limited.
+type SessionLimit struct {
+	// Max number of concurrent sessions per principal, 0 means no limit.
+	Max int
+
+	// Policy to apply when adding a new session would exceed the limit, default is LimitReject.
+	Policy LimitPolicy
+}
+
+// sessLimiter enforces a SessionLimit on the sessions added through a manager.
+// Methods may be called on a nil value, which means there is no limit.
+type sessLimiter struct {
+	limit SessionLimit
+	ist   IndexedStore // Index of the backing store
+	st    StoreCtx     // Backing store to evict sessions from
+
+	// mux serializes adding sessions, so concurrent adds cannot exceed the limit.
+	mux sync.Mutex
+}
+
+// newSessLimiter returns a new sessLimiter enforcing limit on store, nil if there is no limit.
+// An error is returned if store is not indexed.
+func newSessLimiter(limit SessionLimit, store Store) (*sessLimiter, error) {
+	if limit.Max <= 0 {
+		return nil, nil
+	}
+
+	ist, ok := store.(IndexedStore)
+	if a, isAdapter := store.(storeAdapter); !ok && isAdapter {
+		ist, ok = a.StoreCtx.(IndexedStore)
+	}
+	if !ok || ist.IndexCAttr() == "" {
+		return nil, errors.New("session: session limit requires an indexed store (see IndexedStore)")
+	}
+
+	return &sessLimiter{limit: limit, ist: ist, st: NewStoreCtxAdapter(store)}, nil
+}
+
+// add calls add to add sess, enforcing the limit: ErrSessionLimit is returned without calling add
+// if the limit would be exceeded and the policy is LimitReject, else the least recently accessed
+// sessions of the principal are removed after add succeeded, and returned.
+// Sessions are only evicted once the new session is added, so a failing add does not lose sessions.
+// Failures of evicting sessions are logged with logger, they do not make add fail.
+// Adding a session already in the store (e.g. to save it) does not count as a new session.
+func (l *sessLimiter) add(ctx context.Context, sess Session, add func() error, logger *sessLogger) (evicted []Session, err error) {
+	if l == nil {
+		return nil, add()
+	}
+	principal := sess.CAttr(l.ist.IndexCAttr())
+	if !indexable(principal) {
+		return nil, add()
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	sessions, err := l.ist.IndexedSessions(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	others := sessions[:0]
+	for _, s := range sessions {
+		if s.ID() == sess.ID() {
+			return nil, add() // Already in the store
+		}
+		others = append(others, s)
+	}
+
+	excess := len(others) + 1 - l.limit.Max
+	if excess > 0 && l.limit.Policy != LimitEvictLRU {
+		return nil, ErrSessionLimit
+	}
+	if err := add(); err != nil {
+		return nil, err
+	}
+	if excess <= 0 {
+		return nil, nil
+	}
+
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].Accessed().Before(others[j].Accessed())
+	})
+	for _, s := range others[:excess] {
+		if err := l.st.RemoveCtx(ctx, s); err != nil {
+			logger.error("Failed to evict session", err, s.ID())
+			continue
+		}
+		evicted = append(evicted, s)
+	}
+	return evicted, nil
+}
+
+// addLimited adds sess to st enforcing the limit of l, and logs and notifies the listeners
+// about the evicted sessions.
+func addLimited(ctx context.Context, l *sessLimiter, st StoreCtx, sess Session, logger *sessLogger, listeners *eventListeners) error {
+	evicted, err := l.add(ctx, sess, func() error { return st.AddCtx(ctx, sess) }, logger)
+	for _, s := range evicted {
+		logger.evicted(s, "session_limit")
+		listeners.removed(s)
+	}
+	if err == ErrSessionLimit {
+		logger.rejected("session_limit")
+	}
+	return err
+}
+
+// logAddFailure logs that Manager.Add() failed to add sess (e.g. because it was rejected by the session limit),
+// with error level. The standard logger is used if logger is nil (the manager has no log handler).
+func logAddFailure(logger *sessLogger, sess Session, err error) {
+	if logger == nil {
+		log.Println("Failed to add session:", redactIDs(err.Error(), sess.ID()))
+		return
+	}
+	logger.error("Failed to add session", err, sess.ID())
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func newUserSession(user string) Session {
+	return NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"UserName": user}})
+}
+
+func TestSessionLimitReject(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, IndexCAttr: "UserName"})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{
+		AllowHTTP:    true,
+		SessionLimit: SessionLimit{Max: 2},
+	}).(*CookieManager)
+	defer mgr.Close()
+
+	s1, s2 := newUserSession("bob"), newUserSession("bob")
+	eq(nil, mgr.AddCtx(ctx, s1, httptest.NewRecorder()))
+	eq(nil, mgr.AddCtx(ctx, s2, httptest.NewRecorder()))
+
+	w := httptest.NewRecorder()
+	s3 := newUserSession("bob")
+	eq(ErrSessionLimit, mgr.AddCtx(ctx, s3, w))
+	eq(0, len(w.Result().Cookies()))
+	eq(nil, st.Get(s3.ID()))
+	mgr.Add(s3, httptest.NewRecorder())
+	eq(nil, st.Get(s3.ID()))
+
+	// Adding existing sessions again, sessions of other users and anonymous sessions:
+	eq(nil, mgr.AddCtx(ctx, s1, httptest.NewRecorder()))
+	eq(nil, mgr.AddCtx(ctx, newUserSession("alice"), httptest.NewRecorder()))
+	for i := 0; i < 3; i++ {
+		eq(nil, mgr.AddCtx(ctx, NewSession(), httptest.NewRecorder()))
+	}
+
+	// Room is made by removing sessions:
+	mgr.Remove(s1, httptest.NewRecorder())
+	eq(nil, mgr.AddCtx(ctx, s3, httptest.NewRecorder()))
+}
+
+func TestSessionLimitEvictLRU(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, IndexCAttr: "UserName"})
+	mgr := NewHeaderManagerOptions(st, &HeaderMngrOptions{
+		SessionLimit: SessionLimit{Max: 2, Policy: LimitEvictLRU},
+		Listeners:    []EventListener{l},
+	})
+	defer mgr.Close()
+
+	s1, s2 := newUserSession("bob"), newUserSession("bob")
+	mgr.Add(s1, httptest.NewRecorder())
+	mgr.Add(s2, httptest.NewRecorder())
+	time.Sleep(time.Millisecond)
+	st.Get(s1.ID()) // s2 becomes the least recently accessed one
+	l.take()
+
+	s3 := newUserSession("bob")
+	mgr.Add(s3, httptest.NewRecorder())
+	eq(s1, st.Get(s1.ID()))
+	eq(nil, st.Get(s2.ID()))
+	eq(s3, st.Get(s3.ID()))
+	eq("removed:"+s2.ID(), l.take()[0])
+}
+
+func TestSessionLimitAddFails(t *testing.T) {
+	eq := mighty.Eq(t)
+	ctx := context.Background()
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, IndexCAttr: "UserName"})
+	defer st.Close()
+	l, err := newSessLimiter(SessionLimit{Max: 1, Policy: LimitEvictLRU}, st)
+	eq(nil, err)
+
+	s1, s2 := newUserSession("bob"), newUserSession("bob")
+	st.Add(s1)
+
+	// Sessions are not evicted if adding the new one fails:
+	evicted, err := l.add(ctx, s2, func() error { return errTestStore }, nil)
+	eq(errTestStore, err)
+	eq(0, len(evicted))
+	eq(s1, st.Get(s1.ID()))
+
+	evicted, err = l.add(ctx, s2, func() error { st.Add(s2); return nil }, nil)
+	eq(nil, err)
+	eq(1, len(evicted))
+	eq(nil, st.Get(s1.ID()))
+	eq(s2, st.Get(s2.ID()))
+}
+
+func TestSessionLimitNotIndexed(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	panics := func(f func()) (panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+		f()
+		return
+	}
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+	eq(true, panics(func() { NewCookieManagerOptions(st, &CookieMngrOptions{SessionLimit: SessionLimit{Max: 1}}) }))
+	eq(true, panics(func() { NewHeaderManagerOptions(st, &HeaderMngrOptions{SessionLimit: SessionLimit{Max: 1}}) }))
+	eq(false, panics(func() { NewHeaderManagerOptions(st, &HeaderMngrOptions{}) }))
+	eq(true, (&CookieMngrOptions{SessionLimit: SessionLimit{Max: 1}}).Validate(st) != nil)
+	eq(true, (&HeaderMngrOptions{SessionLimit: SessionLimit{Max: 1}}).Validate(st) != nil)
+	eq(nil, (&HeaderMngrOptions{}).Validate(st))
+}
@@ -0,0 +1,245 @@
+/*
+
+Structured logging of session lifecycle events.
+
+*/
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// LogEvent is the kind of a structured log record emitted by stores and managers
+// when a slog.Handler is provided in their options (e.g. InMemStoreOptions.LogHandler).
+//
+// Records never contain raw session IDs, only their fingerprints (see SetIDFingerprint()).
+// Records of events concerning a session have the following attributes:
+//
+//	session    fingerprint of the session ID
+//	reason     reason of the event (e.g. "timeout", "max_lifetime", "invalid_signature")
+//	remaining  remaining lifetime of the session (until it times out or reaches its max lifetime)
+//	attrs      number of attributes of the session
+//
+// Error records have an "error" attribute instead.
+type LogEvent string
+
+// Log events and their default levels.
+const (
+	LogAdded       LogEvent = "added"       // Session added; default level is Info
+	LogAccessed    LogEvent = "accessed"    // Session accessed; default level is Debug
+	LogRemoved     LogEvent = "removed"     // Session removed explicitly; default level is Info
+	LogRegenerated LogEvent = "regenerated" // Session ID regenerated; default level is Info
+	LogExpired     LogEvent = "expired"     // Session timed out or reached its max lifetime; default level is Info
+	LogRejected    LogEvent = "rejected"    // Session ID sent by a client or new session rejected; default level is Warn
+	LogError       LogEvent = "error"       // Operation failed; default level is Error
+)
+
+// defaultLogLevels are the default levels of log events.
+var defaultLogLevels = map[LogEvent]slog.Level{
+	LogAdded:       slog.LevelInfo,
+	LogAccessed:    slog.LevelDebug,
+	LogRemoved:     slog.LevelInfo,
+	LogRegenerated: slog.LevelInfo,
+	LogExpired:     slog.LevelInfo,
+	LogRejected:    slog.LevelWarn,
+	LogError:       slog.LevelError,
+}
+
+// sessLogger logs session lifecycle events and errors either as structured records
+// using a slog.Handler, or as free-form text using a log.Logger.
+// Methods may be called on a nil value, which means logging is disabled.
+type sessLogger struct {
+	handler slog.Handler                        // Handler of structured records, nil means text logging
+	levels  map[LogEvent]slog.Level             // Levels of events, overriding the default ones
+	output  func(calldepth int, s string) error // Function used to log text, nil means text logging is disabled
+
+	textErrorsOnly bool // Tells if only errors are to be logged as text
+}
+
+// newSessLogger returns a new sessLogger.
+// If handler is non-nil, structured records are emitted to it with the given levels (overriding
+// the default levels), else text is logged using logger (the global functions of the log package if nil).
+func newSessLogger(logger *log.Logger, handler slog.Handler, levels map[LogEvent]slog.Level) *sessLogger {
+	if handler != nil {
+		return &sessLogger{handler: handler, levels: levels}
+	}
+	if logger != nil {
+		return &sessLogger{output: logger.Output}
+	}
+	return &sessLogger{output: log.Output}
+}
+
+// newSlogLogger returns a new sessLogger which only emits structured records,
+// nil if handler is nil.
+func newSlogLogger(handler slog.Handler, levels map[LogEvent]slog.Level) *sessLogger {
+	if handler == nil {
+		return nil
+	}
+	return &sessLogger{handler: handler, levels: levels}
+}
+
+// level returns the level of the event.
+func (l *sessLogger) level(ev LogEvent) slog.Level {
+	if lvl, ok := l.levels[ev]; ok {
+		return lvl
+	}
+	return defaultLogLevels[ev]
+}
+
+// emit emits a structured record of the event if the handler is enabled for its level.
+// It returns false if there is no handler, so the caller has to log text.
+func (l *sessLogger) emit(ev LogEvent, msg string, attrs func() []slog.Attr) bool {
+	if l.handler == nil {
+		return false
+	}
+	ctx := context.Background()
+	lvl := l.level(ev)
+	if !l.handler.Enabled(ctx, lvl) {
+		return true
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(4, pcs[:]) // Report the caller of the function logging the event
+	r := slog.NewRecord(time.Now(), lvl, msg, pcs[0])
+	r.AddAttrs(slog.String("event", string(ev)))
+	r.AddAttrs(attrs()...)
+	l.handler.Handle(ctx, r)
+	return true
+}
+
+// text logs the arguments (like log.Println) as text, if text logging of events is enabled.
+// It reports the file and line of the caller of the function logging the event.
+func (l *sessLogger) text(v ...interface{}) {
+	if l.output != nil && !l.textErrorsOnly {
+		l.output(4, fmt.Sprintln(v...))
+	}
+}
+
+// sessAttrs returns the attributes of a record concerning the session.
+func sessAttrs(sess Session, reason string) []slog.Attr {
+	attrs := []slog.Attr{slog.String("session", fingerprint(sess.ID()))}
+	if reason != "" {
+		attrs = append(attrs, slog.String("reason", reason))
+	}
+	remaining := time.Until(expiresAt(sess))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return append(attrs, slog.Duration("remaining", remaining), slog.Int("attrs", len(sess.Attrs())))
+}
+
+// expiredReason tells why the session has expired.
+func expiredReason(sess Session) string {
+	if ml := sess.MaxLifetime(); ml > 0 && !time.Now().Before(sess.Created().Add(ml)) {
+		return "max_lifetime"
+	}
+	return "timeout"
+}
+
+// added logs that the session was added.
+func (l *sessLogger) added(sess Session) {
+	if l == nil {
+		return
+	}
+	if !l.emit(LogAdded, "Session added", func() []slog.Attr { return sessAttrs(sess, "") }) {
+		l.text("Session added:", fingerprint(sess.ID()))
+	}
+}
+
+// accessed logs that the session was accessed.
+// Accesses are not logged as text.
+func (l *sessLogger) accessed(sess Session) {
+	if l == nil {
+		return
+	}
+	l.emit(LogAccessed, "Session accessed", func() []slog.Attr { return sessAttrs(sess, "") })
+}
+
+// removed logs that the session was removed.
+func (l *sessLogger) removed(sess Session) {
+	if l == nil {
+		return
+	}
+	if !l.emit(LogRemoved, "Session removed", func() []slog.Attr { return sessAttrs(sess, "removed") }) {
+		l.text("Session removed:", fingerprint(sess.ID()))
+	}
+}
+
+// evicted logs that the session was removed to make room for other sessions,
+// reason telling the limit being enforced (e.g. "session_limit", "capacity").
+func (l *sessLogger) evicted(sess Session, reason string) {
+	if l == nil {
+		return
+	}
+	if !l.emit(LogRemoved, "Session evicted", func() []slog.Attr { return sessAttrs(sess, reason) }) {
+		l.text("Session evicted:", fingerprint(sess.ID()))
+	}
+}
+
+// regenerated logs that the ID of the session was regenerated, sess2 being the new session.
+func (l *sessLogger) regenerated(sess, sess2 Session) {
+	if l == nil {
+		return
+	}
+	logged := l.emit(LogRegenerated, "Session regenerated", func() []slog.Attr {
+		return append(sessAttrs(sess2, "regenerated"), slog.String("old_session", fingerprint(sess.ID())))
+	})
+	if !logged {
+		l.text("Session regenerated:", fingerprint(sess.ID()), "->", fingerprint(sess2.ID()))
+	}
+}
+
+// expired logs that the session with the given ID has expired.
+// sess may be nil if the session is not available (only its ID is known).
+func (l *sessLogger) expired(id string, sess Session) {
+	if l == nil {
+		return
+	}
+	logged := l.emit(LogExpired, "Session expired", func() []slog.Attr {
+		if sess == nil {
+			return []slog.Attr{slog.String("session", fingerprint(id))}
+		}
+		return sessAttrs(sess, expiredReason(sess))
+	})
+	if !logged {
+		l.text("Session timed out:", fingerprint(id))
+	}
+}
+
+// expiredCount logs that n sessions have expired (when they are removed without being loaded).
+func (l *sessLogger) expiredCount(n int64) {
+	if l == nil {
+		return
+	}
+	if !l.emit(LogExpired, "Sessions expired", func() []slog.Attr { return []slog.Attr{slog.Int64("count", n)} }) {
+		l.text("Sessions timed out:", n)
+	}
+}
+
+// rejected logs that a session ID sent by a client was rejected for the given reason.
+func (l *sessLogger) rejected(reason string) {
+	if l == nil {
+		return
+	}
+	if !l.emit(LogRejected, "Session ID rejected", func() []slog.Attr { return []slog.Attr{slog.String("reason", reason)} }) {
+		l.text("Session ID rejected:", reason)
+	}
+}
+
+// error logs that an operation failed, msg describing the operation (e.g. "Failed to get session").
+// ids are the IDs of the sessions concerned, which are redacted in the error message.
+func (l *sessLogger) error(msg string, err error, ids ...string) {
+	if l == nil {
+		return
+	}
+	errMsg := redactIDs(err.Error(), ids...)
+	if !l.emit(LogError, msg, func() []slog.Attr { return []slog.Attr{slog.String("error", errMsg)} }) && l.output != nil {
+		l.output(3, fmt.Sprintln(msg+":", errMsg))
+	}
+}
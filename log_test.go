@@ -0,0 +1,162 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, as records may be written
+// by the session cleaner goroutine.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.buf.Reset()
+}
+
+// jsonRecords decodes the records written by a slog.JSONHandler.
+func jsonRecords(t *testing.T, buf *syncBuffer) (records []map[string]interface{}) {
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	buf.Reset()
+	return
+}
+
+func TestSlogInMemStore(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	buf := &syncBuffer{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		LogHandler:          slog.NewJSONHandler(buf, nil), // Info level, accesses are not logged by default
+	})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond, Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	st.Get(s.ID())
+	time.Sleep(60 * time.Millisecond)
+
+	eq(false, strings.Contains(buf.String(), s.ID()))
+	rs := jsonRecords(t, buf)
+	eq(2, len(rs))
+	eq("INFO", rs[0]["level"])
+	eq("added", rs[0]["event"])
+	eq(IDHash(s.ID()), rs[0]["session"])
+	eq(1.0, rs[0]["attrs"])
+	eq(true, rs[0]["remaining"].(float64) > 0)
+	eq("expired", rs[1]["event"])
+	eq("timeout", rs[1]["reason"])
+	eq(0.0, rs[1]["remaining"])
+
+	// Levels may be changed:
+	st2 := NewInMemStoreOptions(&InMemStoreOptions{
+		LogHandler: slog.NewJSONHandler(buf, nil),
+		LogLevels:  map[LogEvent]slog.Level{LogAccessed: slog.LevelInfo, LogAdded: slog.LevelDebug},
+	})
+	defer st2.Close()
+	s = NewSession()
+	st2.Add(s)
+	st2.Get(s.ID())
+	rs = jsonRecords(t, buf)
+	eq(1, len(rs))
+	eq("accessed", rs[0]["event"])
+}
+
+func TestSlogCookieManager(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	buf := &syncBuffer{}
+	mgr := NewCookieManagerOptions(NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger}), &CookieMngrOptions{
+		AllowHTTP:   true,
+		SigningKeys: [][]byte{[]byte("0123456789abcdef0123456789abcdef")},
+		LogHandler:  slog.NewJSONHandler(buf, nil),
+	})
+	defer mgr.Close()
+
+	s := NewSession()
+	mgr.Add(s, httptest.NewRecorder())
+	s2 := mgr.Regenerate(s, httptest.NewRecorder())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "sessid="+s2.ID()+".AAAA")
+	eq(nil, mgr.Get(r))
+
+	eq(false, strings.Contains(buf.String(), s.ID()))
+	eq(false, strings.Contains(buf.String(), s2.ID()))
+	rs := jsonRecords(t, buf)
+	eq(3, len(rs))
+	eq("added", rs[0]["event"])
+	eq("regenerated", rs[1]["event"])
+	eq(IDHash(s2.ID()), rs[1]["session"])
+	eq(IDHash(s.ID()), rs[1]["old_session"])
+	eq("rejected", rs[2]["event"])
+	eq("WARN", rs[2]["level"])
+	eq("invalid_signature", rs[2]["reason"])
+}
+
+func TestSlogStoreAdapter(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	buf := &syncBuffer{}
+	st := NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{
+		LogHandler: slog.NewJSONHandler(buf, nil),
+		LogLevels:  map[LogEvent]slog.Level{LogError: slog.LevelWarn},
+	})
+
+	st.Add(NewSession())
+	rs := jsonRecords(t, buf)
+	eq(1, len(rs))
+	eq("WARN", rs[0]["level"])
+	eq("error", rs[0]["event"])
+	eq("Failed to add session", rs[0]["msg"])
+	eq(errTestStore.Error(), rs[0]["error"])
+}
+
+func TestTextLogging(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	// Without a handler, the Logger is used (IDs are fingerprinted too):
+	buf := &bytes.Buffer{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: log.New(buf, "", 0)})
+	defer st.Close()
+
+	s := NewSession()
+	st.Add(s)
+	st.Get(s.ID())
+	st.Remove(s)
+	eq("Session added: "+IDHash(s.ID())+"\nSession removed: "+IDHash(s.ID())+"\n", buf.String())
+}
@@ -1,12 +1,13 @@
 /*
 
-Session Manager interface.
+Session Manager interfaces.
 
 */
 
 package session
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -21,11 +22,49 @@ type Manager interface {
 
 	// Add adds the session to the HTTP response.
 	// This means to let the client know about the specified session by including the sesison id in the response somehow.
+	// If the session cannot be added (e.g. it is rejected by the session limit of the manager, see SessionLimit),
+	// it is not added to the response, and the failure is only logged; use ManagerCtx.AddCtx() to handle failures.
 	Add(sess Session, w http.ResponseWriter)
 
 	// Remove removes the session from the HTTP response.
 	Remove(sess Session, w http.ResponseWriter)
 
+	// Regenerate changes the ID of the session, and returns the session with the new ID.
+	// It should be called when the privilege level of the session changes (e.g. after login),
+	// to prevent session fixation attacks.
+	// The returned session has the same creation time and attributes, the old session is invalidated
+	// (removed from the backing store), and the new session is added to the HTTP response.
+	// nil is returned if regeneration fails, e.g. if the session is not in the backing store anymore
+	// (it has been removed or it has expired, see ErrSessionNotFound), so revoked sessions cannot be revived.
+	Regenerate(sess Session, w http.ResponseWriter) Session
+
+	// Close closes the session manager, releasing any resources that were allocated.
+	Close()
+}
+
+// ManagerCtx is a context-aware session manager interface whose operations report failures
+// of the backing store.
+// It is the counterpart of Manager for handlers that want to handle store failures.
+type ManagerCtx interface {
+	// GetCtx returns the session specified by the HTTP request.
+	// The context of the request is used for the store operation.
+	// nil session and nil error is returned if the request does not contain a session,
+	// or the contained session is not know by this manager.
+	GetCtx(r *http.Request) (Session, error)
+
+	// AddCtx adds the session to the HTTP response.
+	// This means to let the client know about the specified session by including the sesison id in the response somehow.
+	// The client is only informed about the session if adding it to the store succeeds.
+	AddCtx(ctx context.Context, sess Session, w http.ResponseWriter) error
+
+	// RemoveCtx removes the session from the HTTP response.
+	// The client is informed about the removal even if removing it from the store fails.
+	RemoveCtx(ctx context.Context, sess Session, w http.ResponseWriter) error
+
+	// RegenerateCtx changes the ID of the session, and returns the session with the new ID.
+	// See Manager.Regenerate() for details.
+	RegenerateCtx(ctx context.Context, sess Session, w http.ResponseWriter) (Session, error)
+
 	// Close closes the session manager, releasing any resources that were allocated.
 	Close()
 }
@@ -0,0 +1,200 @@
+/*
+
+HTTP middleware which resolves the session of requests, and makes it available via the request context.
+
+*/
+
+package session
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ctxKey is the type of the context key the session is stored under.
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx in which sess is stored.
+// The session can be retrieved with FromContext().
+func NewContext(ctx context.Context, sess Session) context.Context {
+	return context.WithValue(ctx, ctxKey{}, sess)
+}
+
+// FromContext returns the session stored in ctx (e.g. by the Middleware), nil if there is none.
+func FromContext(ctx context.Context) Session {
+	sess, _ := ctx.Value(ctxKey{}).(Session)
+	return sess
+}
+
+// MwOptions defines options that may be passed when creating a new session middleware.
+// All fields are optional; default value will be used for any field that has the zero value.
+type MwOptions struct {
+	// Tells if a new session is to be created lazily for requests without a session; default is false.
+	// If true, FromContext() never returns nil: for requests without a session it returns a new session
+	// which is added (Manager.Add()) on the first Session.SetAttr() call with a non-nil value
+	// (or on the first Session.Update() or Session.CompareAndSwapAttr() call storing an attribute).
+	// SetAttr() must be called before the response headers are written, else the client cannot be informed
+	// about the new session.
+	LazyCreate bool
+
+	// Options to create new sessions with if LazyCreate is true; default is to use the default options.
+	SessOptions *SessOptions
+
+	// ErrorHandler is called if the Manager fails to get the session of a request
+	// (only if the Manager implements ManagerCtx). Default is to respond with
+	// 500 Internal Server Error, and log the error.
+	// Session IDs are redacted in the errors of the managers of this package, so they can be logged safely.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Pointer to zero value of MwOptions to be reused for efficiency.
+var zeroMwOptions = new(MwOptions)
+
+// Middleware returns an HTTP handler which resolves the session of requests once using m,
+// and calls next with a request whose context holds the session.
+// Handlers may retrieve the session with FromContext(r.Context()).
+// Default values of options are listed in the MwOptions type.
+func Middleware(m Manager, next http.Handler) http.Handler {
+	return MiddlewareOptions(m, next, zeroMwOptions)
+}
+
+// MiddlewareOptions returns an HTTP handler which resolves the session of requests once using m,
+// and calls next with a request whose context holds the session.
+// Handlers may retrieve the session with FromContext(r.Context()).
+//
+// If m implements ManagerCtx, failures to get the session are handled by MwOptions.ErrorHandler.
+// If m is a CookieManager, session ID cookies signed with previous signing keys are re-signed.
+// If m implements Saver, the session is saved after next returns (e.g. modified sessions
+// are persisted by stores which do not persist changes automatically); failures are logged.
+// If the ID of the session has been regenerated with m during the request (e.g. on login),
+// the new session is saved.
+func MiddlewareOptions(m Manager, next http.Handler, o *MwOptions) http.Handler {
+	errorHandler := o.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("Failed to get session:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+	sessOptions := o.SessOptions
+	if sessOptions == nil {
+		sessOptions = zeroSessOptions
+	}
+	lazyCreate := o.LazyCreate
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sess Session
+		if mc, ok := m.(ManagerCtx); ok {
+			var err error
+			if sess, err = mc.GetCtx(r); err != nil {
+				errorHandler(w, r, err)
+				return
+			}
+		} else {
+			sess = m.Get(r)
+		}
+
+		if sess != nil {
+			if rs, ok := m.(resigner); ok {
+				rs.Resign(sess, r, w)
+			}
+		} else if lazyCreate {
+			sess = &lazySession{Session: NewSessionOptions(sessOptions), m: m, w: w}
+		}
+
+		if sess == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.WithContext(NewContext(r.Context(), sess))
+		next.ServeHTTP(w, r)
+
+		if sv, ok := m.(Saver); ok {
+			if ls, ok := sess.(*lazySession); ok {
+				if !ls.added {
+					return // Not added, nothing to save
+				}
+				sess = ls.Session
+			}
+			sess = current(sess) // The ID of the session may have been regenerated (e.g. on login)
+			if err := sv.Save(r.Context(), sess); err != nil {
+				log.Println("Failed to save session:", redactIDs(err.Error(), sess.ID()))
+			}
+		}
+	})
+}
+
+// resigner is implemented by managers that can re-sign session cookies (e.g. CookieManager).
+type resigner interface {
+	Resign(sess Session, r *http.Request, w http.ResponseWriter)
+}
+
+// lazySession is a new session which is added to the Manager on the first SetAttr() call
+// with a non-nil value.
+type lazySession struct {
+	Session                     // The new session
+	m       Manager             // Manager to add the session to
+	w       http.ResponseWriter // Response to add the session to
+	once    sync.Once           // To add the session only once
+	added   bool                // Tells if the session has been added
+}
+
+// SetAttr is to implement Session.SetAttr().
+// The session is added to the manager on the first call with a non-nil value.
+func (s *lazySession) SetAttr(name string, value interface{}) {
+	s.Session.SetAttr(name, value)
+	if value != nil {
+		s.add()
+	}
+}
+
+// Update is to implement Session.Update().
+// The session is added to the manager on the first call which leaves attributes in the session.
+func (s *lazySession) Update(f func(attrs map[string]interface{})) {
+	empty := false
+	s.Session.Update(func(attrs map[string]interface{}) {
+		f(attrs)
+		empty = len(attrs) == 0
+	})
+	if !empty {
+		s.add()
+	}
+}
+
+// CompareAndSwapAttr is to implement Session.CompareAndSwapAttr().
+// The session is added to the manager on the first successful swap to a non-nil value.
+func (s *lazySession) CompareAndSwapAttr(name string, old, new interface{}) bool {
+	swapped := s.Session.CompareAndSwapAttr(name, old, new)
+	if swapped && new != nil {
+		s.add()
+	}
+	return swapped
+}
+
+// add adds the session to the manager, only once.
+func (s *lazySession) add() {
+	s.once.Do(func() {
+		s.m.Add(s.Session, s.w)
+		s.added = true
+	})
+}
+
+// addLazy adds sess if it is a session created lazily by the middleware which has not been added yet,
+// and returns the added session. Such sessions need no regeneration (see Manager.Regenerate()):
+// their IDs have not been sent to the client yet.
+func addLazy(sess Session) (Session, bool) {
+	ls, ok := sess.(*lazySession)
+	if !ok || ls.added {
+		return nil, false
+	}
+	ls.add()
+	return ls.Session, true
+}
+
+// unwrap returns the wrapped session.
+func (s *lazySession) unwrap() Session {
+	return s.Session
+}
@@ -0,0 +1,178 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestContext(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	eq(nil, FromContext(context.Background()))
+	s := NewSession()
+	eq(s, FromContext(NewContext(context.Background(), s)))
+}
+
+func TestMiddleware(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	var got Session
+	h := Middleware(mgr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	eq(nil, got)
+
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr.Add(s, w)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(w.Result().Cookies()[0])
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	neq(nil, got)
+	eq(s, got)
+}
+
+func TestMiddlewareLazyCreate(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	h := MiddlewareOptions(mgr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := FromContext(r.Context())
+		if r.URL.Path == "/set" {
+			sess.SetAttr("a", 1)
+			sess.SetAttr("b", 2)
+		}
+		w.Write([]byte(sess.ID()))
+	}), &MwOptions{LazyCreate: true})
+
+	// Session is not added if it's not used:
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	eq(0, len(w.Result().Cookies()))
+	eq(nil, st.Get(w.Body.String()))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/set", nil))
+	eq(1, len(w.Result().Cookies()))
+	s := st.Get(w.Body.String())
+	neq(nil, s)
+	eq(1, s.Attr("a"))
+	eq(2, s.Attr("b"))
+
+	// Update and CompareAndSwapAttr also add the session:
+	ls := &lazySession{Session: NewSession(), m: mgr, w: httptest.NewRecorder()}
+	ls.Update(func(attrs map[string]interface{}) {})
+	eq(nil, st.Get(ls.ID()))
+	ls.Update(func(attrs map[string]interface{}) { attrs["a"] = 1 })
+	neq(nil, st.Get(ls.ID()))
+	ls = &lazySession{Session: NewSession(), m: mgr, w: httptest.NewRecorder()}
+	ls.CompareAndSwapAttr("a", nil, 1)
+	neq(nil, st.Get(ls.ID()))
+
+	// Wrapped sessions must be usable like any other sessions:
+	ls = &lazySession{Session: NewSession(), m: mgr, w: httptest.NewRecorder()}
+	_, err := MarshalSession(ls, GobCodec{})
+	eq(nil, err)
+	neq(nil, mgr.Regenerate(ls, httptest.NewRecorder()))
+
+	// Regenerating a session not yet added adds it (its ID has not been sent to the client):
+	ls = &lazySession{Session: NewSession(), m: mgr, w: httptest.NewRecorder()}
+	s = mgr.Regenerate(ls, ls.w)
+	neq(nil, s)
+	eq(s, st.Get(s.ID()))
+	eq(1, len(ls.w.(*httptest.ResponseRecorder).Result().Cookies()))
+}
+
+func TestMiddlewareError(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	mgr := NewCookieManager(NewStoreAdapterOptions(errStore{}, &StoreAdapterOptions{Logger: NoopLogger}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessid", Value: "asdf"})
+
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	var gotErr error
+	h := MiddlewareOptions(mgr, next, &MwOptions{
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			gotErr = err
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	eq(false, called)
+	eq(true, errors.Is(gotErr, errTestStore))
+	eq(http.StatusServiceUnavailable, w.Code)
+}
+
+func TestMiddlewareResign(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	k1, k2 := []byte("key-1"), []byte("key-2")
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	mgr1 := NewCookieManagerOptions(st, &CookieMngrOptions{SigningKeys: [][]byte{k1}})
+	s := NewSession()
+	w := httptest.NewRecorder()
+	mgr1.Add(s, w)
+	c := w.Result().Cookies()[0]
+
+	mgr2 := NewCookieManagerOptions(st, &CookieMngrOptions{SigningKeys: [][]byte{k2, k1}})
+	h := Middleware(mgr2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	cookies := w.Result().Cookies()
+	eq(1, len(cookies))
+	neq(c.Value, cookies[0].Value)
+}
+
+func TestMiddlewareSaveRegenerated(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	srv := newRESPServer(t, "")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{Logger: NoopLogger})
+	mgr := NewCookieManagerOptions(st, &CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	// The login flow: the ID of the session is regenerated, then the session is modified.
+	h := Middleware(mgr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := FromContext(r.Context())
+		sess = mgr.Regenerate(sess, w)
+		sess.SetAttr("user", "bob")
+		w.Write([]byte(sess.ID()))
+	}))
+
+	s := NewSession()
+	st.Add(s)
+	r := httptest.NewRequest("GET", "/login", nil)
+	r.AddCookie(&http.Cookie{Name: "sessid", Value: s.ID()})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	// The new session is saved at the end of the request:
+	id := w.Body.String()
+	neq(s.ID(), id)
+	eq(nil, st.Get(s.ID()))
+	s2 := st.Get(id)
+	neq(nil, s2)
+	eq("bob", s2.Attr("user"))
+}
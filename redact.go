@@ -0,0 +1,134 @@
+/*
+
+Redaction of session IDs in logs.
+
+*/
+
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+)
+
+// Session IDs are bearer credentials: anyone knowing the ID of a session can use it.
+// So they are never logged by this package, only their fingerprints are,
+// which may be used to correlate log records of a session.
+//
+// The fingerprinting function can be changed with SetIDFingerprint(),
+// full IDs may only be logged in debug builds, see SetLogFullIDs().
+
+// idFingerprint holds the function used to fingerprint session IDs in logs.
+var idFingerprint atomic.Pointer[func(id string) string]
+
+// logFullIDs tells if full session IDs are to be logged (only possible in debug builds).
+var logFullIDs atomic.Bool
+
+// SetIDFingerprint sets the function used to fingerprint session IDs in all logs of the package
+// (both text and structured logs); default is IDHash.
+// Use e.g. HMACFingerprint() so fingerprints of IDs cannot be computed without a key,
+// or PrefixFingerprint() for shorter, human readable fingerprints.
+// Passing nil restores the default.
+// It is safe to call SetIDFingerprint concurrently with logging.
+func SetIDFingerprint(f func(id string) string) {
+	if f == nil {
+		idFingerprint.Store(nil)
+		return
+	}
+	idFingerprint.Store(&f)
+}
+
+// SetLogFullIDs enables or disables logging full session IDs instead of their fingerprints,
+// which may help debugging. It only has effect in debug builds (built with the "sessiondebug" build tag),
+// so full IDs never end up in the logs of production builds by accident.
+// The return value tells if full IDs are logged.
+func SetLogFullIDs(enable bool) bool {
+	logFullIDs.Store(enable && debugBuild)
+	return logFullIDs.Load()
+}
+
+// IDHash returns the SHA-256 hash based fingerprint of a session ID, the default fingerprint used in logs.
+// It is the first 16 hex digits of the SHA-256 hash of the ID.
+func IDHash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// HMACFingerprint returns a fingerprinting function to be used with SetIDFingerprint(),
+// which returns the first 16 hex digits of the HMAC-SHA256 of IDs with the given key.
+// Unlike with IDHash, fingerprints of known IDs cannot be computed without the key.
+func HMACFingerprint(key []byte) func(id string) string {
+	key = append([]byte(nil), key...)
+	return func(id string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(id))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+}
+
+// PrefixFingerprint returns a fingerprinting function to be used with SetIDFingerprint(),
+// which returns the first n characters of IDs followed by "...".
+// Keep n small: the prefix reduces the number of guesses needed to find a valid ID.
+func PrefixFingerprint(n int) func(id string) string {
+	return func(id string) string {
+		if len(id) > n {
+			id = id[:n]
+		}
+		return id + "..."
+	}
+}
+
+// fingerprint returns the representation of a session ID in logs.
+func fingerprint(id string) string {
+	if logFullIDs.Load() {
+		return id
+	}
+	if f := idFingerprint.Load(); f != nil {
+		return (*f)(id)
+	}
+	return IDHash(id)
+}
+
+// redactIDs replaces the session IDs occurring in s with their fingerprints.
+func redactIDs(s string, ids ...string) string {
+	for _, id := range ids {
+		if id != "" {
+			s = strings.ReplaceAll(s, id, fingerprint(id))
+		}
+	}
+	return s
+}
+
+// redactedError is an error whose message has the session IDs replaced with their fingerprints.
+// The original error is available with errors.Unwrap(), so errors.Is() and errors.As() still work.
+type redactedError struct {
+	msg string // Redacted message
+	err error  // Original error
+}
+
+// Error is to implement error.Error().
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error.
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactErr returns err with the given session IDs replaced with their fingerprints in its message,
+// so it can be safely logged, e.g. by the default error handler of the middleware.
+// Returns err itself if it is nil or if none of the IDs occur in its message.
+func redactErr(err error, ids ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if redacted := redactIDs(msg, ids...); redacted != msg {
+		return &redactedError{msg: redacted, err: err}
+	}
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build !sessiondebug
+
+package session
+
+// debugBuild tells if this is a debug build, in which full session IDs may be logged (see SetLogFullIDs()).
+const debugBuild = false
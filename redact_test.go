@@ -0,0 +1,107 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+func TestIDHash(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	eq(16, len(IDHash("asdf")))
+	eq(IDHash("asdf"), IDHash("asdf"))
+	neq(IDHash("asdf"), IDHash("asdg"))
+}
+
+func TestSetIDFingerprint(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	defer SetIDFingerprint(nil)
+
+	id := "0123456789abcdef"
+	eq(IDHash(id), fingerprint(id))
+
+	SetIDFingerprint(PrefixFingerprint(4))
+	eq("0123...", fingerprint(id))
+	eq("01...", fingerprint("01"))
+
+	f := HMACFingerprint([]byte("key"))
+	SetIDFingerprint(f)
+	eq(16, len(fingerprint(id)))
+	neq(IDHash(id), fingerprint(id))
+	neq(f(id), HMACFingerprint([]byte("key2"))(id))
+
+	SetIDFingerprint(nil)
+	eq(IDHash(id), fingerprint(id))
+}
+
+func TestSetLogFullIDs(t *testing.T) {
+	eq := mighty.Eq(t)
+	defer SetLogFullIDs(false)
+
+	id := "0123456789abcdef"
+	eq(debugBuild, SetLogFullIDs(true))
+	if debugBuild {
+		eq(id, fingerprint(id))
+	} else {
+		eq(IDHash(id), fingerprint(id))
+	}
+	eq(false, SetLogFullIDs(false))
+	eq(IDHash(id), fingerprint(id))
+}
+
+func TestRedactErrors(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	buf := &bytes.Buffer{}
+	l := newSessLogger(log.New(buf, "", 0), nil, nil)
+	id := NewSession().ID()
+	l.error("Failed to get session", errors.New("open /tmp/"+id+".sess: permission denied"), id)
+	eq("Failed to get session: open /tmp/"+IDHash(id)+".sess: permission denied\n", buf.String())
+
+	// Errors of the file store contain file paths:
+	buf.Reset()
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{Logger: log.New(buf, "", 0)})
+	eq(nil, err)
+	defer st.Close()
+	id = NewSession().ID()
+	eq(nil, os.Mkdir(filepath.Join(dir, id+sessFileExt), 0700)) // Session file cannot be read
+	eq(nil, st.Get(id))
+	eq(true, strings.Contains(buf.String(), "Failed to get session"))
+	eq(true, strings.Contains(buf.String(), IDHash(id)))
+	eq(false, strings.Contains(buf.String(), id))
+}
+
+func TestRedactMiddlewareError(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	dir := t.TempDir()
+	st, err := NewFileStoreOptions(dir, &FileStoreOptions{Logger: NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+	mgr := NewCookieManager(st)
+	id := NewSession().ID()
+	eq(nil, os.Mkdir(filepath.Join(dir, id+sessFileExt), 0700)) // Session file cannot be read
+
+	var gotErr error
+	h := MiddlewareOptions(mgr, http.NotFoundHandler(), &MwOptions{
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) { gotErr = err },
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sessid", Value: id})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var pathErr *os.PathError
+	eq(true, errors.As(gotErr, &pathErr))
+	eq(true, strings.Contains(gotErr.Error(), IDHash(id)))
+	eq(false, strings.Contains(gotErr.Error(), id))
+}
@@ -0,0 +1,340 @@
+/*
+
+A Redis (RESP protocol) based session store implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Redis based session Store implementation.
+// Sessions are stored as string values, expiration is handled by Redis using key TTLs,
+// so no session cleaner goroutine is needed.
+type redisStore struct {
+	pool      *respPool       // Connection pool
+	keyPrefix string          // Prefix of keys of sessions
+	codec     Codec           // Codec to encode sessions with
+	logger    *sessLogger     // Logger of session lifecycle events and errors
+	listeners *eventListeners // Listeners to notify about session lifecycle events
+}
+
+// RedisStoreOptions defines options that may be passed when creating a new Redis based Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type RedisStoreOptions struct {
+	// Password to authenticate with (AUTH command), default is no authentication.
+	Password string
+
+	// Database to use (SELECT command), default is 0.
+	DB int
+
+	// Prefix of the keys the sessions are stored under, default is "session:".
+	KeyPrefix string
+
+	// Timeout for dialing and for executing commands (unless a context with deadline is used),
+	// default is 5 seconds.
+	Timeout time.Duration
+
+	// Max number of idle connections to keep, default is 8.
+	MaxIdleConns int
+
+	// Codec to encode sessions with, default is GobCodec.
+	// Sessions encoded with other registered codecs (see RegisterCodec()) can also be decoded,
+	// so the codec may be changed without losing existing sessions.
+	Codec Codec
+
+	// Logger to log session lifecycle events (e.g. added, removed) and errors.
+	// Default is to use the global functions of the log package.
+	// To disable logging, you may use NoopLogger.
+	Logger *log.Logger
+
+	// Handler to emit structured log records of session lifecycle events and errors with (see LogEvent),
+	// default is none. If set, Logger is not used.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// Expired sessions are removed by Redis silently, so EventListener.OnExpired() is not called.
+	Listeners []EventListener
+}
+
+// Pointer to zero value of RedisStoreOptions to be reused for efficiency.
+var zeroRedisStoreOptions = new(RedisStoreOptions)
+
+// NewRedisStore returns a new, Redis based session Store with the default options,
+// which connects to the server at the given address (e.g. "localhost:6379").
+// Default values of options are listed in the RedisStoreOptions type.
+// See NewRedisStoreOptions() for details.
+func NewRedisStore(addr string) Store {
+	return NewRedisStoreOptions(addr, zeroRedisStoreOptions)
+}
+
+// NewRedisStoreOptions returns a new, Redis based session Store with the specified options,
+// which connects to the server at the given address (e.g. "localhost:6379").
+// Connections are established lazily, when needed.
+//
+// The store speaks the RESP protocol directly, so it works with Redis and any compatible server.
+// Sessions expire using native key TTLs derived from Session.Timeout() (capped by Session.MaxLifetime()),
+// the TTL is reset each time the session is accessed (Store.Get()).
+//
+// Changes made to a session (e.g. Session.SetAttr()) are not persisted automatically:
+// to save them, call Store.Add() (or Manager.Add()) again with the session, or use
+// the Middleware which saves modified sessions at the end of requests (see Saver).
+//
+// Only sessions created by this package (NewSession() and NewSessionOptions()) can be stored.
+// Sessions are encoded using the codec specified in the options (GobCodec by default),
+// types of attribute values must be registered with the codec (e.g. gob.Register() for GobCodec).
+//
+// The returned Store also implements StoreCtx, which reports failures of the operations,
+// VersionedStore, so sessions can be modified safely using UpdateInStore(), and Saver.
+func NewRedisStoreOptions(addr string, o *RedisStoreOptions) Store {
+	s := &redisStore{
+		pool: &respPool{
+			addr:     addr,
+			password: o.Password,
+			db:       o.DB,
+			timeout:  o.Timeout,
+			maxIdle:  o.MaxIdleConns,
+		},
+		keyPrefix: o.KeyPrefix,
+		logger:    newSessLogger(o.Logger, o.LogHandler, o.LogLevels),
+		codec:     o.Codec,
+		listeners: newEventListeners(o.Listeners),
+	}
+
+	if s.pool.timeout == 0 {
+		s.pool.timeout = 5 * time.Second
+	}
+	if s.pool.maxIdle == 0 {
+		s.pool.maxIdle = 8
+	}
+	if s.keyPrefix == "" {
+		s.keyPrefix = "session:"
+	}
+	if s.codec == nil {
+		s.codec = GobCodec{}
+	}
+
+	return s
+}
+
+// setCmd returns the command to store the session with a TTL derived from its expiration time.
+// nil is returned if the session has already expired.
+func (s *redisStore) setCmd(sess Session) ([]string, error) {
+	data, err := MarshalSession(sess, s.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := time.Until(expiresAt(sess)).Milliseconds()
+	if ttl <= 0 {
+		return nil, nil
+	}
+	return []string{"SET", s.keyPrefix + sess.ID(), string(data), "PX", strconv.FormatInt(ttl, 10)}, nil
+}
+
+// set stores the session with a TTL derived from its expiration time.
+func (s *redisStore) set(ctx context.Context, sess Session) error {
+	version := sess.Version()
+	cmd, err := s.setCmd(sess)
+	if cmd == nil {
+		return err
+	}
+	if _, err = s.pool.do(ctx, cmd...); err != nil {
+		return err
+	}
+	sess.MarkSaved(version)
+	return nil
+}
+
+// touch resets the TTL of the session, derived from its expiration time.
+func (s *redisStore) touch(ctx context.Context, sess Session) error {
+	ttl := time.Until(expiresAt(sess)).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+	_, err := s.pool.do(ctx, "PEXPIRE", s.keyPrefix+sess.ID(), strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// AddCtx is to implement StoreCtx.AddCtx().
+func (s *redisStore) AddCtx(ctx context.Context, sess Session) error {
+	s.logger.added(sess)
+	if err := s.set(ctx, sess); err != nil {
+		return err
+	}
+	s.listeners.added(sess)
+	return nil
+}
+
+// GetCtx is to implement StoreCtx.GetCtx().
+func (s *redisStore) GetCtx(ctx context.Context, id string) (Session, error) {
+	reply, err := s.pool.do(ctx, "GET", s.keyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := reply.([]byte)
+	if data == nil {
+		return nil, nil
+	}
+
+	sess, err := decodeSession(data, s.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the TTL is updated, so concurrent modifications of the session are not overwritten:
+	sess.Access()
+	if expired(sess, time.Now()) {
+		return nil, nil
+	}
+	if err := s.touch(ctx, sess); err != nil {
+		return nil, err
+	}
+	s.logger.accessed(sess)
+	s.listeners.accessed(sess)
+	return sess, nil
+}
+
+// RemoveCtx is to implement StoreCtx.RemoveCtx().
+func (s *redisStore) RemoveCtx(ctx context.Context, sess Session) error {
+	s.logger.removed(sess)
+	reply, err := s.pool.do(ctx, "DEL", s.keyPrefix+sess.ID())
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n > 0 {
+		s.listeners.removed(sess)
+	}
+	return nil
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+// The old session is checked, the new session is stored and the old one is deleted
+// in a WATCH / MULTI / EXEC transaction.
+func (s *redisStore) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := s.setCmd(sess2)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil {
+		return nil, ErrSessionNotFound // Expired
+	}
+
+	key := s.keyPrefix + sess.ID()
+	for retries := 0; ; retries++ {
+		err = s.pool.watchTransaction(ctx, key, func(value []byte) ([][]string, error) {
+			if value == nil {
+				return nil, ErrSessionNotFound // Removed or expired
+			}
+			return [][]string{cmd, {"DEL", key}}, nil
+		})
+		// The old session may be touched concurrently, which aborts the transaction:
+		if err != errRESPAborted || retries == 2 {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.logger.regenerated(sess, sess2)
+	s.listeners.removed(sess)
+	s.listeners.created(sess2)
+	return sess2, nil
+}
+
+// SaveIfVersion is to implement VersionedStore.SaveIfVersion().
+// The stored session is checked and replaced in a WATCH / MULTI / EXEC transaction.
+func (s *redisStore) SaveIfVersion(ctx context.Context, sess Session, version uint64) error {
+	newVersion := sess.Version()
+	err := s.pool.watchTransaction(ctx, s.keyPrefix+sess.ID(), func(value []byte) ([][]string, error) {
+		if value == nil {
+			return nil, ErrVersionConflict
+		}
+		stored, err := decodeSession(value, s.codec)
+		if err != nil {
+			return nil, err
+		}
+		if stored.Version() != version {
+			return nil, ErrVersionConflict
+		}
+
+		cmd, err := s.setCmd(sess)
+		if err != nil {
+			return nil, err
+		}
+		if cmd == nil {
+			return nil, ErrVersionConflict // Expired, as if it did not exist
+		}
+		return [][]string{cmd}, nil
+	})
+	if err == errRESPAborted {
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	sess.MarkSaved(newVersion)
+	return nil
+}
+
+// Save is to implement Saver.Save().
+// The session is only stored if its key exists (SET with the XX option),
+// so removed or expired sessions are not resurrected.
+func (s *redisStore) Save(ctx context.Context, sess Session) error {
+	if !dirty(sess) {
+		return s.touch(ctx, sess)
+	}
+
+	version := sess.Version()
+	cmd, err := s.setCmd(sess)
+	if cmd == nil {
+		return err
+	}
+	if _, err = s.pool.do(ctx, append(cmd, "XX")...); err != nil {
+		return err
+	}
+	sess.MarkSaved(version)
+	return nil
+}
+
+// Get is to implement Store.Get().
+func (s *redisStore) Get(id string) Session {
+	sess, err := s.GetCtx(context.Background(), id)
+	if err != nil {
+		s.logger.error("Failed to get session", err, id)
+		return nil
+	}
+	return sess
+}
+
+// Add is to implement Store.Add().
+func (s *redisStore) Add(sess Session) {
+	if err := s.AddCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to add session", err, sess.ID())
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *redisStore) Remove(sess Session) {
+	if err := s.RemoveCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to remove session", err, sess.ID())
+	}
+}
+
+// Close is to implement Store.Close().
+func (s *redisStore) Close() {
+	s.pool.close()
+}
@@ -0,0 +1,322 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// respServer is a local stand-in RESP server supporting the commands used by redisStore.
+type respServer struct {
+	l        net.Listener
+	password string
+
+	mux     sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	mods    map[string]int // Modification counters of keys, for WATCH
+}
+
+func newRESPServer(t *testing.T, password string) *respServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &respServer{
+		l:        l,
+		password: password,
+		values:   map[string]string{},
+		expires:  map[string]time.Time{},
+		mods:     map[string]int{},
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	c := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	authed := srv.password == ""
+	var queue [][]string        // Commands queued in a MULTI block, nil if not in a MULTI block
+	watched := map[string]int{} // Modification counters of watched keys
+	for {
+		req, err := c.readReply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, v := range req.([]interface{}) {
+			args = append(args, string(v.([]byte)))
+		}
+
+		cmd := strings.ToUpper(args[0])
+		switch {
+		case cmd == "AUTH":
+			authed = args[1] == srv.password
+			if authed {
+				fmt.Fprint(c.w, "+OK\r\n")
+			} else {
+				fmt.Fprint(c.w, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprint(c.w, "-NOAUTH Authentication required.\r\n")
+		case cmd == "MULTI":
+			queue = [][]string{}
+			fmt.Fprint(c.w, "+OK\r\n")
+		case cmd == "WATCH":
+			srv.mux.Lock()
+			srv.expire()
+			for _, k := range args[1:] {
+				watched[k] = srv.mods[k]
+			}
+			srv.mux.Unlock()
+			fmt.Fprint(c.w, "+OK\r\n")
+		case cmd == "UNWATCH":
+			watched = map[string]int{}
+			fmt.Fprint(c.w, "+OK\r\n")
+		case cmd == "DISCARD":
+			queue, watched = nil, map[string]int{}
+			fmt.Fprint(c.w, "+OK\r\n")
+		case cmd == "EXEC":
+			srv.mux.Lock()
+			srv.expire()
+			aborted := false
+			for k, mod := range watched {
+				aborted = aborted || srv.mods[k] != mod
+			}
+			if aborted {
+				fmt.Fprint(c.w, "*-1\r\n")
+			} else {
+				fmt.Fprintf(c.w, "*%d\r\n", len(queue))
+				for _, q := range queue {
+					srv.execLocked(c, strings.ToUpper(q[0]), q[1:])
+				}
+			}
+			srv.mux.Unlock()
+			queue, watched = nil, map[string]int{}
+		case queue != nil:
+			queue = append(queue, args)
+			fmt.Fprint(c.w, "+QUEUED\r\n")
+		default:
+			srv.exec(c, cmd, args[1:])
+		}
+		c.w.Flush()
+	}
+}
+
+func (srv *respServer) exec(c *respConn, cmd string, args []string) {
+	srv.mux.Lock()
+	defer srv.mux.Unlock()
+
+	srv.expire()
+	srv.execLocked(c, cmd, args)
+}
+
+// expire deletes expired keys. srv.mux must be locked.
+func (srv *respServer) expire() {
+	for k, exp := range srv.expires {
+		if !time.Now().Before(exp) {
+			delete(srv.values, k)
+			delete(srv.expires, k)
+			srv.mods[k]++
+		}
+	}
+}
+
+// execLocked executes a command. srv.mux must be locked.
+func (srv *respServer) execLocked(c *respConn, cmd string, args []string) {
+	switch cmd {
+	case "PING", "SELECT":
+		fmt.Fprint(c.w, "+OK\r\n")
+	case "GET":
+		if v, ok := srv.values[args[0]]; ok {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(v), v)
+		} else {
+			fmt.Fprint(c.w, "$-1\r\n")
+		}
+	case "SET":
+		var px int
+		var xx bool
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				i++
+				px, _ = strconv.Atoi(args[i])
+			case "XX":
+				xx = true
+			}
+		}
+		if _, ok := srv.values[args[0]]; xx && !ok {
+			fmt.Fprint(c.w, "$-1\r\n")
+			break
+		}
+		srv.values[args[0]] = args[1]
+		delete(srv.expires, args[0])
+		if px > 0 {
+			srv.expires[args[0]] = time.Now().Add(time.Duration(px) * time.Millisecond)
+		}
+		srv.mods[args[0]]++
+		fmt.Fprint(c.w, "+OK\r\n")
+	case "PEXPIRE":
+		if _, ok := srv.values[args[0]]; !ok {
+			fmt.Fprint(c.w, ":0\r\n")
+			break
+		}
+		ms, _ := strconv.Atoi(args[1])
+		srv.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		srv.mods[args[0]]++
+		fmt.Fprint(c.w, ":1\r\n")
+	case "DEL":
+		n := 0
+		for _, k := range args {
+			if _, ok := srv.values[k]; ok {
+				n++
+			}
+			delete(srv.values, k)
+			delete(srv.expires, k)
+			srv.mods[k]++
+		}
+		fmt.Fprintf(c.w, ":%d\r\n", n)
+	default:
+		fmt.Fprintf(c.w, "-ERR unknown command '%s'\r\n", cmd)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	srv := newRESPServer(t, "secret")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{
+		Password: "secret",
+		Logger:   NoopLogger,
+	})
+	defer st.Close()
+
+	eq(nil, st.Get("asdf"))
+
+	s := NewSessionOptions(&SessOptions{
+		CAttrs: map[string]interface{}{"ca": "x"},
+		Attrs:  map[string]interface{}{"a": 1},
+	})
+	st.Add(s)
+	time.Sleep(10 * time.Millisecond)
+
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	neq(s2.Accessed(), s2.Created())
+	eq("x", s2.CAttr("ca"))
+	eq(1, s2.Attr("a"))
+
+	s2.SetAttr("b", "y")
+	st.Add(s2)
+	eq("y", st.Get(s.ID()).Attr("b"))
+
+	s3, err := st.(Regenerator).Regenerate(context.Background(), s2)
+	eq(nil, err)
+	neq(s.ID(), s3.ID())
+	eq(nil, st.Get(s.ID()))
+	eq("y", st.Get(s3.ID()).Attr("b"))
+
+	st.Remove(s3)
+	eq(nil, st.Get(s3.ID()))
+}
+
+func TestRedisStoreAuthFailure(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	srv := newRESPServer(t, "secret")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{
+		Password: "bad",
+		Logger:   NoopLogger,
+	})
+	defer st.Close()
+
+	s := NewSession()
+	st.Add(s)
+	eq(nil, st.Get(s.ID()))
+}
+
+func TestRedisStoreTTL(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	srv := newRESPServer(t, "")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Timeout: 50 * time.Millisecond})
+	st.Add(s)
+	neq(nil, st.Get(s.ID()))
+
+	// Access resets the TTL:
+	time.Sleep(30 * time.Millisecond)
+	neq(nil, st.Get(s.ID()))
+	time.Sleep(30 * time.Millisecond)
+	neq(nil, st.Get(s.ID()))
+
+	time.Sleep(80 * time.Millisecond)
+	eq(nil, st.Get(s.ID()))
+}
+
+func TestRedisStoreVersioned(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	srv := newRESPServer(t, "")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"count": 0}})
+	st.Add(s)
+
+	testVersionedStore(t, st.(StoreCtx), s.ID())
+
+	// Session values are decoded on each access, so stale values are rejected:
+	ctx := context.Background()
+	s1, _ := st.(StoreCtx).GetCtx(ctx, s.ID())
+	s2, _ := st.(StoreCtx).GetCtx(ctx, s.ID())
+	v := s1.Version()
+	s1.SetAttr("a", 1)
+	eq(nil, st.(VersionedStore).SaveIfVersion(ctx, s1, v))
+	s2.SetAttr("a", 2)
+	eq(ErrVersionConflict, st.(VersionedStore).SaveIfVersion(ctx, s2, v))
+	eq(1, st.Get(s.ID()).Attr("a"))
+
+	st.Remove(s)
+	eq(ErrVersionConflict, st.(VersionedStore).SaveIfVersion(ctx, s1, s1.Version()))
+}
+
+func TestRedisStoreSave(t *testing.T) {
+	srv := newRESPServer(t, "")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	testSaver(t, st)
+}
+
+func TestRedisStoreRegenerateRevoked(t *testing.T) {
+	srv := newRESPServer(t, "")
+	st := NewRedisStoreOptions(srv.l.Addr().String(), &RedisStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	testRegenerateRevoked(t, st)
+}
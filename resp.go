@@ -0,0 +1,292 @@
+/*
+
+A minimal client of the RESP (REdis Serialization Protocol) protocol.
+
+*/
+
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// respError is an error reply sent by the server.
+type respError string
+
+// Error is to implement error.Error().
+func (e respError) Error() string {
+	return "session: RESP error: " + string(e)
+}
+
+// errRESPAborted is returned if a transaction is aborted because a watched key was modified.
+var errRESPAborted = errors.New("session: RESP transaction aborted")
+
+// respConn is a connection to a RESP server.
+type respConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool // Tells if the connection is broken (an error other than an error reply occurred)
+}
+
+// do sends a command and reads its reply.
+// The reply is one of string (simple string), int64 (integer), []byte (bulk string, nil for null),
+// []interface{} (array, nil for null; error elements are respError values).
+// Error replies are returned as a respError error, all other errors mean the connection is broken
+// (and mark it as such).
+func (c *respConn) do(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	reply, err := c.send(ctx, timeout, args...)
+	if _, ok := err.(respError); err != nil && !ok {
+		c.broken = true
+	}
+	return reply, err
+}
+
+// send sends a command and reads its reply.
+func (c *respConn) send(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok && timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+// readReply reads a reply from the connection.
+func (c *respConn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("session: invalid RESP reply: empty line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []byte(nil), err
+		}
+		data := make([]byte, n+2) // +2 for the trailing CRLF
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []interface{}(nil), err
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			// Error elements do not break the connection, so keep reading:
+			v, err := c.readReply()
+			if re, ok := err.(respError); ok {
+				v = re
+			} else if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	}
+
+	return nil, fmt.Errorf("session: invalid RESP reply type: %q", line[0])
+}
+
+// readLine reads a CRLF terminated line, without the CRLF.
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("session: invalid RESP line ending")
+	}
+	return line[:len(line)-2], nil
+}
+
+// respPool is a pool of RESP connections.
+type respPool struct {
+	addr     string        // Address of the server
+	password string        // Password to authenticate with, optional
+	db       int           // Database to select
+	timeout  time.Duration // Dial and I/O timeout
+	maxIdle  int           // Max number of idle connections to keep
+
+	mux    sync.Mutex  // Mutex to protect idle and closed
+	idle   []*respConn // Idle connections
+	closed bool        // Tells if the pool is closed
+}
+
+// do executes a command using a connection of the pool.
+func (p *respPool) do(ctx context.Context, args ...string) (reply interface{}, err error) {
+	err = p.withConn(ctx, func(c *respConn) error {
+		reply, err = c.do(ctx, p.timeout, args...)
+		return err
+	})
+	return
+}
+
+// watchTransaction watches key, reads its value (nil if it does not exist), and executes the commands
+// returned by f atomically in a MULTI / EXEC block, using a single connection of the pool.
+// If f returns an error or no commands, no transaction is executed.
+// errRESPAborted is returned if key is modified by another client before the transaction is executed.
+func (p *respPool) watchTransaction(ctx context.Context, key string, f func(value []byte) ([][]string, error)) error {
+	return p.withConn(ctx, func(c *respConn) error {
+		if _, err := c.do(ctx, p.timeout, "WATCH", key); err != nil {
+			return err
+		}
+
+		cmds, err := func() ([][]string, error) {
+			reply, err := c.do(ctx, p.timeout, "GET", key)
+			if err != nil {
+				return nil, err
+			}
+			value, _ := reply.([]byte)
+			return f(value)
+		}()
+		if err != nil || len(cmds) == 0 {
+			// The connection must not be put back to the pool with a watched key:
+			if _, err2 := c.do(ctx, p.timeout, "UNWATCH"); err2 != nil {
+				c.broken = true
+			}
+			return err
+		}
+
+		return p.multiExec(ctx, c, cmds)
+	})
+}
+
+// multiExec executes the commands atomically in a MULTI / EXEC block using c.
+func (p *respPool) multiExec(ctx context.Context, c *respConn, cmds [][]string) error {
+	if _, err := c.do(ctx, p.timeout, "MULTI"); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if _, err := c.do(ctx, p.timeout, cmd...); err != nil {
+			c.do(ctx, p.timeout, "DISCARD")
+			return err
+		}
+	}
+	reply, err := c.do(ctx, p.timeout, "EXEC")
+	if err != nil {
+		return err
+	}
+
+	results, _ := reply.([]interface{})
+	if results == nil {
+		return errRESPAborted
+	}
+	for _, r := range results {
+		if re, ok := r.(respError); ok {
+			return re
+		}
+	}
+	return nil
+}
+
+// withConn calls f with a connection of the pool.
+// The connection is returned to the pool afterwards, unless it is broken.
+func (p *respPool) withConn(ctx context.Context, f func(c *respConn) error) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(c)
+	if c.broken {
+		c.conn.Close()
+		return err
+	}
+	p.put(c)
+	return err
+}
+
+// get returns an idle connection, or dials a new one if there are no idle connections.
+func (p *respPool) get(ctx context.Context) (*respConn, error) {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return nil, errors.New("session: RESP pool is closed")
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mux.Unlock()
+		return c, nil
+	}
+	p.mux.Unlock()
+
+	d := net.Dialer{Timeout: p.timeout}
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if p.password != "" {
+		if _, err := c.do(ctx, p.timeout, "AUTH", p.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do(ctx, p.timeout, "SELECT", strconv.Itoa(p.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// put returns a connection to the pool.
+func (p *respPool) put(c *respConn) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed || len(p.idle) >= p.maxIdle {
+		c.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// close closes the pool and all idle connections.
+func (p *respPool) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.closed = true
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+}
@@ -9,7 +9,11 @@ package session
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"io"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -43,6 +47,39 @@ type Session interface {
 	// Safe for concurrent use.
 	Attrs() map[string]interface{}
 
+	// Update calls f with the attributes stored in the session, under the session lock,
+	// so read-modify-write operations (e.g. incrementing a counter) are atomic.
+	// f may modify the attrs map; it must not retain it and must not call other methods of the session.
+	// Safe for concurrent use.
+	Update(f func(attrs map[string]interface{}))
+
+	// CompareAndSwapAttr sets the value of an attribute to new only if its current value equals old.
+	// A nil old value means the attribute must not exist, a nil new value deletes the attribute.
+	// Values are compared with ==, values of non-comparable types are never equal.
+	// Reports whether the value was swapped.
+	// Safe for concurrent use.
+	CompareAndSwapAttr(name string, old, new interface{}) (swapped bool)
+
+	// Version returns the version of the attributes of the session, which is incremented
+	// each time the attributes are modified (by SetAttr(), Update() or CompareAndSwapAttr()).
+	// Stores may use it for optimistic concurrency control, see VersionedStore.
+	Version() uint64
+
+	// Modified returns the time when the attributes were last modified,
+	// the zero time if they have not been modified since the session was created.
+	Modified() time.Time
+
+	// DirtyAttrs returns the names of the attributes modified since the session was created
+	// or loaded, or since it was last saved (see MarkSaved()).
+	// The session is dirty (needs to be saved) if the result is not empty.
+	// Safe for concurrent use.
+	DirtyAttrs() []string
+
+	// MarkSaved tells the session that its state with the given version has been persisted.
+	// Dirty attributes are cleared, unless the session has been modified since (its version differs).
+	// Users do not need to call this as the session store is responsible for that.
+	MarkSaved(version uint64)
+
 	// Created returns the session creation time.
 	Created() time.Time
 
@@ -53,6 +90,11 @@ type Session interface {
 	// A session may be removed automatically if it is not accessed for this duration.
 	Timeout() time.Duration
 
+	// MaxLifetime returns the max lifetime of the session, 0 means no limit.
+	// A session may be removed automatically when this duration passes since its creation,
+	// regardless of how often it is accessed.
+	MaxLifetime() time.Duration
+
 	// Mutex returns the RW mutex of the session.
 	// It is used to synchronize access/modification of the state stored in the session.
 	// It can be used if session-level synchronization is required.
@@ -69,15 +111,23 @@ type Session interface {
 }
 
 // Session implementation.
-// Fields are exported so a session may be marshalled / unmarshalled.
+// Fields are exported so sessions encoded directly with encoding/gob by previous versions
+// of this package can still be decoded. Use MarshalSession() and UnmarshalSession()
+// to marshal / unmarshal sessions.
 type sessionImpl struct {
-	IDF       string                 // ID of the session
-	CreatedF  time.Time              // Creation time
-	AccessedF time.Time              // Last accessed time
-	CAttrsF   map[string]interface{} // Constant attributes specified at session creation
-	AttrsF    map[string]interface{} // Attributes stored in the session
-	TimeoutF  time.Duration          // Session timeout
-	mux       *sync.RWMutex          // RW mutex to synchronize session state access
+	IDF          string                 // ID of the session
+	CreatedF     time.Time              // Creation time
+	AccessedF    time.Time              // Last accessed time
+	CAttrsF      map[string]interface{} // Constant attributes specified at session creation
+	AttrsF       map[string]interface{} // Attributes stored in the session
+	TimeoutF     time.Duration          // Session timeout
+	MaxLifetimeF time.Duration          // Session max lifetime, 0 means no limit
+	VersionF     uint64                 // Version of the attributes
+	ModifiedF    time.Time              // Last modification time of the attributes
+	dirty        map[string]struct{}    // Names of the attributes modified since last saved
+	listeners    []*eventListeners      // Listeners to notify about attribute changes
+	successor    Session                // Session which replaced this one by regenerating its ID, may be nil
+	mux          *sync.RWMutex          // RW mutex to synchronize session state access
 }
 
 // SessOptions defines options that may be passed when creating a new Session.
@@ -93,8 +143,13 @@ type SessOptions struct {
 	Attrs map[string]interface{}
 
 	// Session timeout, default is 30 minutes.
+	// This is an idle timeout: the session expires if it is not accessed for this duration.
 	Timeout time.Duration
 
+	// Max lifetime of the session, default is 0 which means no limit.
+	// The session expires when this duration passes since its creation, regardless of how often it is accessed.
+	MaxLifetime time.Duration
+
 	// Byte-length of the information that builds up the session ids.
 	// Using Base-64 encoding, id length will be this multiplied by 4/3 chars.
 	// Default value is 18 (which means length of ID will be 24 chars).
@@ -123,12 +178,13 @@ func NewSessionOptions(o *SessOptions) Session {
 	}
 
 	sess := sessionImpl{
-		IDF:       genID(idLength),
-		CreatedF:  now,
-		AccessedF: now,
-		AttrsF:    make(map[string]interface{}),
-		TimeoutF:  timeout,
-		mux:       &sync.RWMutex{},
+		IDF:          genID(idLength),
+		CreatedF:     now,
+		AccessedF:    now,
+		AttrsF:       make(map[string]interface{}),
+		TimeoutF:     timeout,
+		MaxLifetimeF: o.MaxLifetime,
+		mux:          &sync.RWMutex{},
 	}
 
 	if len(o.CAttrs) > 0 {
@@ -152,6 +208,130 @@ func genID(length int) string {
 	return base64.URLEncoding.EncodeToString(r)
 }
 
+// expiresAt returns the time when the session expires, unless it is accessed before that:
+// the last accessed time plus the timeout, capped by the creation time plus the max lifetime (if set).
+func expiresAt(sess Session) time.Time {
+	t := sess.Accessed().Add(sess.Timeout())
+	if ml := sess.MaxLifetime(); ml > 0 {
+		if t2 := sess.Created().Add(ml); t2.Before(t) {
+			t = t2
+		}
+	}
+	return t
+}
+
+// expired tells if the session has expired by now (timed out or exceeded its max lifetime).
+func expired(sess Session, now time.Time) bool {
+	return now.After(expiresAt(sess))
+}
+
+// validID tells if id is a syntactically valid session id as generated by genID.
+// IDs coming from clients should be checked before they are used to address
+// resources such as files.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sessionWrapper is implemented by Session implementations of this package that wrap another session.
+type sessionWrapper interface {
+	unwrap() Session
+}
+
+// toImpl returns the sessionImpl of the session, unwrapping wrapped sessions.
+// ok is false if sess was not created by this package.
+func toImpl(sess Session) (s *sessionImpl, ok bool) {
+	for {
+		w, isWrapper := sess.(sessionWrapper)
+		if !isWrapper {
+			break
+		}
+		sess = w.unwrap()
+	}
+	s, ok = sess.(*sessionImpl)
+	return
+}
+
+// errUnsupportedSession is returned when trying to encode a Session
+// that was not created by this package.
+var errUnsupportedSession = errors.New("session: unsupported Session implementation")
+
+// regenerateID returns a copy of the session with a new ID.
+// The new ID has the same length as the ID of sess.
+// Creation time and attributes are kept, the last accessed time is set to the current time.
+// Only sessions created by this package can be copied.
+func regenerateID(sess Session) (Session, error) {
+	s, ok := toImpl(sess)
+	if !ok {
+		return nil, errUnsupportedSession
+	}
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	idLength := base64.URLEncoding.DecodedLen(len(s.IDF)) - strings.Count(s.IDF, "=")
+	s2 := &sessionImpl{
+		IDF:          genID(idLength),
+		CreatedF:     s.CreatedF,
+		AccessedF:    time.Now(),
+		AttrsF:       make(map[string]interface{}, len(s.AttrsF)),
+		TimeoutF:     s.TimeoutF,
+		MaxLifetimeF: s.MaxLifetimeF,
+		VersionF:     s.VersionF,
+		ModifiedF:    s.ModifiedF,
+		mux:          &sync.RWMutex{},
+	}
+	if s.CAttrsF != nil {
+		s2.CAttrsF = make(map[string]interface{}, len(s.CAttrsF))
+		for k, v := range s.CAttrsF {
+			s2.CAttrsF[k] = v
+		}
+	}
+	for k, v := range s.AttrsF {
+		s2.AttrsF[k] = v
+	}
+
+	return s2, nil
+}
+
+// setSuccessor records that sess has been replaced by sess2 by regenerating its ID,
+// so code still holding sess (e.g. the Middleware) can find the current session with current().
+func setSuccessor(sess, sess2 Session) {
+	if s, ok := toImpl(sess); ok {
+		s.mux.Lock()
+		s.successor = sess2
+		s.mux.Unlock()
+	}
+}
+
+// current returns the session which replaced sess by (possibly repeatedly) regenerating its ID,
+// or sess itself if its ID has not been regenerated.
+func current(sess Session) Session {
+	for {
+		s, ok := toImpl(sess)
+		if !ok {
+			return sess
+		}
+		s.mux.RLock()
+		next := s.successor
+		s.mux.RUnlock()
+		if next == nil {
+			return sess
+		}
+		sess = next
+	}
+}
+
 // ID is to implement Session.ID().
 func (s *sessionImpl) ID() string {
 	return s.IDF
@@ -177,14 +357,118 @@ func (s *sessionImpl) Attr(name string) interface{} {
 
 // SetAttr is to implement Session.SetAttr().
 func (s *sessionImpl) SetAttr(name string, value interface{}) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+	s.change(func() []attrChange {
+		old := s.AttrsF[name]
+		if value == nil {
+			delete(s.AttrsF, name)
+		} else {
+			s.AttrsF[name] = value
+		}
+		return []attrChange{{name, old, value}}
+	})
+}
+
+// Update is to implement Session.Update().
+// Attributes are compared before and after calling f to find the modified ones;
+// attributes with non-comparable values (e.g. slices) are considered modified,
+// as they may have been modified in place.
+func (s *sessionImpl) Update(f func(attrs map[string]interface{})) {
+	s.change(func() []attrChange {
+		old := make(map[string]interface{}, len(s.AttrsF))
+		for k, v := range s.AttrsF {
+			old[k] = v
+		}
+
+		f(s.AttrsF)
 
-	if value == nil {
-		delete(s.AttrsF, name)
-	} else {
-		s.AttrsF[name] = value
+		var changes []attrChange
+		for k, v := range s.AttrsF {
+			if ov, ok := old[k]; !ok || !equalValues(ov, v) {
+				changes = append(changes, attrChange{k, ov, v})
+			}
+		}
+		for k, ov := range old {
+			if _, ok := s.AttrsF[k]; !ok {
+				changes = append(changes, attrChange{k, ov, nil})
+			}
+		}
+		return changes
+	})
+}
+
+// CompareAndSwapAttr is to implement Session.CompareAndSwapAttr().
+func (s *sessionImpl) CompareAndSwapAttr(name string, old, new interface{}) (swapped bool) {
+	s.change(func() []attrChange {
+		if swapped = equalValues(s.AttrsF[name], old); !swapped {
+			return nil
+		}
+		if new == nil {
+			delete(s.AttrsF, name)
+		} else {
+			s.AttrsF[name] = new
+		}
+		return []attrChange{{name, old, new}}
+	})
+	return
+}
+
+// change calls f which changes attributes holding the session lock, and returns the changes.
+// The changes are registered, and attached listeners are notified about them after the lock is released.
+func (s *sessionImpl) change(f func() []attrChange) {
+	var (
+		changes []attrChange
+		ls      []*eventListeners
+	)
+	func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		if changes = f(); len(changes) == 0 {
+			return
+		}
+		names := make([]string, len(changes))
+		for i, c := range changes {
+			names[i] = c.name
+		}
+		s.modified(names...)
+		ls = s.listeners
+	}()
+
+	notifyAttrChanges(s, ls, changes...)
+}
+
+// modified registers the modification of the named attributes.
+// s.mux must be locked.
+func (s *sessionImpl) modified(names ...string) {
+	if s.dirty == nil {
+		s.dirty = make(map[string]struct{}, len(names))
+	}
+	for _, name := range names {
+		s.dirty[name] = struct{}{}
+	}
+	s.VersionF++
+	s.ModifiedF = time.Now()
+}
+
+// equalValues tells if a and b are equal using ==,
+// without panicking if they are of the same, non-comparable type.
+func equalValues(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() || !va.Comparable() || !vb.Comparable() {
+		return false
 	}
+	return a == b
+}
+
+// Version is to implement Session.Version().
+func (s *sessionImpl) Version() uint64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.VersionF
 }
 
 // Attrs is to implement Session.Attrs().
@@ -217,6 +501,11 @@ func (s *sessionImpl) Timeout() time.Duration {
 	return s.TimeoutF
 }
 
+// MaxLifetime is to implement Session.MaxLifetime().
+func (s *sessionImpl) MaxLifetime() time.Duration {
+	return s.MaxLifetimeF
+}
+
 // Mutex is to implement Session.Mutex().
 func (s *sessionImpl) Mutex() *sync.RWMutex {
 	return s.mux
@@ -229,3 +518,37 @@ func (s *sessionImpl) Access() {
 
 	s.AccessedF = time.Now()
 }
+
+// Modified is to implement Session.Modified().
+func (s *sessionImpl) Modified() time.Time {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	return s.ModifiedF
+}
+
+// DirtyAttrs is to implement Session.DirtyAttrs().
+func (s *sessionImpl) DirtyAttrs() []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if len(s.dirty) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.dirty))
+	for name := range s.dirty {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MarkSaved is to implement Session.MarkSaved().
+func (s *sessionImpl) MarkSaved(version uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.VersionF == version {
+		s.dirty = nil
+	}
+}
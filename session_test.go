@@ -3,6 +3,7 @@ package session
 import (
 	"encoding/base64"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,10 +44,11 @@ func TestSessOptions(t *testing.T) {
 	eq := mighty.Eq(t)
 
 	so := &SessOptions{
-		Attrs:    map[string]interface{}{"a": 1},
-		CAttrs:   map[string]interface{}{"ca": 2},
-		IDLength: 9,
-		Timeout:  43 * time.Minute,
+		Attrs:       map[string]interface{}{"a": 1},
+		CAttrs:      map[string]interface{}{"ca": 2},
+		IDLength:    9,
+		Timeout:     43 * time.Minute,
+		MaxLifetime: 2 * time.Hour,
 	}
 
 	s := NewSessionOptions(so)
@@ -62,4 +64,131 @@ func TestSessOptions(t *testing.T) {
 	eq(so.IDLength, len(data))
 
 	eq(so.Timeout, s.Timeout())
+	eq(so.MaxLifetime, s.MaxLifetime())
+}
+
+func TestExpiresAt(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{Timeout: time.Hour})
+	eq(s.Accessed().Add(time.Hour), expiresAt(s))
+	eq(false, expired(s, time.Now()))
+	eq(true, expired(s, time.Now().Add(2*time.Hour)))
+
+	// Max lifetime caps expiration:
+	s = NewSessionOptions(&SessOptions{Timeout: time.Hour, MaxLifetime: time.Minute})
+	eq(s.Created().Add(time.Minute), expiresAt(s))
+	eq(true, expired(s, time.Now().Add(2*time.Minute)))
+
+	// Max lifetime longer than the timeout does not matter:
+	s = NewSessionOptions(&SessOptions{Timeout: time.Minute, MaxLifetime: time.Hour})
+	eq(s.Accessed().Add(time.Minute), expiresAt(s))
+}
+
+func TestRegenerateID(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	for _, idLength := range []int{9, 10, 18} {
+		s := NewSessionOptions(&SessOptions{
+			Attrs:    map[string]interface{}{"a": 1},
+			CAttrs:   map[string]interface{}{"ca": 2},
+			IDLength: idLength,
+		})
+		time.Sleep(time.Millisecond)
+
+		s2, err := regenerateID(s)
+		eq(nil, err)
+		neq(s.ID(), s2.ID())
+		eq(len(s.ID()), len(s2.ID()))
+		eq(s.Created(), s2.Created())
+		neq(s.Accessed(), s2.Accessed())
+		eq(s.Timeout(), s2.Timeout())
+		eq(true, reflect.DeepEqual(s.Attrs(), s2.Attrs()))
+		eq(2, s2.CAttr("ca"))
+
+		// Attributes must not be shared:
+		s2.SetAttr("a", 3)
+		eq(1, s.Attr("a"))
+	}
+}
+
+func TestSessionUpdate(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"count": 0}})
+	eq(uint64(0), s.Version())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Update(func(attrs map[string]interface{}) {
+				attrs["count"] = attrs["count"].(int) + 1
+			})
+		}()
+	}
+	wg.Wait()
+	eq(100, s.Attr("count"))
+	eq(uint64(100), s.Version())
+
+	s.SetAttr("a", 1)
+	eq(uint64(101), s.Version())
+}
+
+func TestSessionCompareAndSwapAttr(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	s := NewSession()
+	eq(false, s.CompareAndSwapAttr("a", 1, 2))
+	eq(true, s.CompareAndSwapAttr("a", nil, 1))
+	eq(false, s.CompareAndSwapAttr("a", nil, 2))
+	eq(false, s.CompareAndSwapAttr("a", int64(1), 2))
+	eq(true, s.CompareAndSwapAttr("a", 1, 2))
+	eq(2, s.Attr("a"))
+	eq(uint64(2), s.Version())
+
+	// Non-comparable values must not panic:
+	s.SetAttr("b", []int{1})
+	eq(false, s.CompareAndSwapAttr("b", []int{1}, 2))
+
+	eq(true, s.CompareAndSwapAttr("a", 2, nil))
+	eq(nil, s.Attr("a"))
+}
+
+func TestSessionDirty(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	eq(0, len(s.DirtyAttrs()))
+	eq(true, s.Modified().IsZero())
+
+	s.SetAttr("b", 2)
+	eq(true, reflect.DeepEqual([]string{"b"}, s.DirtyAttrs()))
+	eq(false, s.Modified().IsZero())
+
+	v := s.Version()
+	s.Update(func(attrs map[string]interface{}) { attrs["a"] = 1 }) // No change
+	eq(v, s.Version())
+	s.Update(func(attrs map[string]interface{}) {
+		delete(attrs, "a")
+		attrs["c"] = 3
+	})
+	eq(true, reflect.DeepEqual([]string{"a", "b", "c"}, s.DirtyAttrs()))
+
+	// Modified since v, must stay dirty:
+	s.MarkSaved(v)
+	eq(3, len(s.DirtyAttrs()))
+	s.MarkSaved(s.Version())
+	eq(0, len(s.DirtyAttrs()))
+
+	// Dirty state is not encoded, modification time is:
+	s.SetAttr("d", 4)
+	data, err := MarshalSession(s, GobCodec{})
+	eq(nil, err)
+	s2, err := UnmarshalSession(data)
+	eq(nil, err)
+	eq(0, len(s2.DirtyAttrs()))
+	eq(true, s.Modified().Equal(s2.Modified()))
+	neq(uint64(0), s2.Version())
 }
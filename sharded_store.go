@@ -0,0 +1,202 @@
+/*
+
+A sharded in-memory session store implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"hash/maphash"
+	"sort"
+	"time"
+)
+
+// Sharded in-memory session Store implementation.
+// Sessions are distributed among shards by the hash of their IDs, each shard being an inMemStore
+// with its own lock (and its share of the bounds of the store), so operations on sessions
+// of different shards do not contend.
+type shardedInMemStore struct {
+	shards      []*inMemStore   // Shards of the store
+	seed        maphash.Seed    // Seed of the hash of session IDs
+	closeTicker chan struct{}   // Channel to signal close for the session cleaner
+	logger      *sessLogger     // Logger of session lifecycle events and errors, shared by the shards
+	listeners   *eventListeners // Listeners to notify about session lifecycle events, shared by the shards
+	indexCAttr  string          // Name of the constant attribute sessions are indexed by, may be empty
+	snapshot    *snapshotFile   // Snapshot file, nil if snapshots are disabled
+	journal     *journal        // Journal of changes, shared by the shards; nil if journaling is disabled
+}
+
+// newShardedInMemStore returns a new sharded in-memory Store with the specified options
+// and number of shards, which must be greater than 1.
+// The returned Store has an automatic session cleaner which runs in its own goroutine,
+// and sweeps a single shard at a time, so that each shard is swept once in every interval.
+func newShardedInMemStore(o *InMemStoreOptions, shards int, interval time.Duration) Store {
+	s := &shardedInMemStore{
+		shards:      make([]*inMemStore, shards),
+		seed:        maphash.MakeSeed(),
+		closeTicker: make(chan struct{}),
+		logger:      newSessLogger(o.Logger, o.LogHandler, o.LogLevels),
+		indexCAttr:  o.IndexCAttr,
+	}
+	listeners, sl := storeListeners(o)
+	s.listeners = listeners
+	if sl != nil {
+		sl.st = s
+	}
+
+	for i := range s.shards {
+		s.shards[i] = newInMemStore(o, newShardBound(o, i, shards), s.logger, s.listeners)
+	}
+
+	shardInterval := interval / time.Duration(len(s.shards))
+	if shardInterval <= 0 {
+		shardInterval = 1
+	}
+
+	s.snapshot = newSnapshotFile(snapshotName(o), s, s.logger)
+	if o.JournalFile != "" {
+		s.journal = openJournal(o, s, s.snapshot, s.logger)
+		for _, sh := range s.shards {
+			sh.journal = s.journal
+		}
+	} else {
+		s.snapshot.restore()
+	}
+
+	go s.sessCleaner(shardInterval)
+	if s.snapshot != nil && o.SnapshotInterval > 0 {
+		go s.snapshot.run(o.SnapshotInterval, s.closeTicker)
+	}
+	if s.journal != nil {
+		go s.journal.run(s.closeTicker)
+	}
+
+	return s
+}
+
+// sessCleaner periodically sweeps the shards one after the other in an endless loop.
+// This method is to be started as a new goroutine.
+func (s *shardedInMemStore) sessCleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for i := 0; ; i = (i + 1) % len(s.shards) {
+		select {
+		case <-s.closeTicker:
+			// We are being shut down...
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			s.shards[i].sweep(now)
+		}
+	}
+}
+
+// shard returns the shard of the session with the given ID.
+func (s *shardedInMemStore) shard(id string) *inMemStore {
+	return s.shards[maphash.String(s.seed, id)%uint64(len(s.shards))]
+}
+
+// Get is to implement Store.Get().
+func (s *shardedInMemStore) Get(id string) Session {
+	return s.shard(id).Get(id)
+}
+
+// Add is to implement Store.Add().
+// Only the shard of the session evicts sessions if it exceeds its bounds.
+func (s *shardedInMemStore) Add(sess Session) {
+	s.shard(sess.ID()).Add(sess)
+}
+
+// Remove is to implement Store.Remove().
+func (s *shardedInMemStore) Remove(sess Session) {
+	s.shard(sess.ID()).Remove(sess)
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+func (s *shardedInMemStore) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new session is likely in another shard, shards are locked one after the other
+	// (never both at the same time) to avoid deadlocks.
+	src, dst := s.shard(sess.ID()), s.shard(sess2.ID())
+	err = func() error {
+		src.mux.Lock()
+		defer src.mux.Unlock()
+
+		if cur := src.sessions[sess.ID()]; cur == nil || expired(cur, time.Now()) {
+			return ErrSessionNotFound
+		}
+		s.logger.regenerated(sess, sess2)
+		src.del(sess.ID())
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	evicted := func() []Session {
+		dst.mux.Lock()
+		defer dst.mux.Unlock()
+
+		dst.put(sess2)
+		return dst.evict()
+	}()
+
+	s.journal.commit()
+	for _, sess := range evicted {
+		s.listeners.removed(sess)
+	}
+	s.listeners.removed(sess)
+	s.listeners.created(sess2)
+	return sess2, nil
+}
+
+// IndexCAttr is to implement IndexedStore.IndexCAttr().
+func (s *shardedInMemStore) IndexCAttr() string {
+	return s.indexCAttr
+}
+
+// IndexedSessions is to implement IndexedStore.IndexedSessions().
+func (s *shardedInMemStore) IndexedSessions(ctx context.Context, value interface{}) ([]Session, error) {
+	var sessions []Session
+	for _, sh := range s.shards {
+		ss, err := sh.IndexedSessions(ctx, value)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, ss...)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created().Before(sessions[j].Created())
+	})
+	return sessions, nil
+}
+
+// RemoveIndexed is to implement IndexedStore.RemoveIndexed().
+func (s *shardedInMemStore) RemoveIndexed(ctx context.Context, value interface{}) (int, error) {
+	total := 0
+	for _, sh := range s.shards {
+		n, err := sh.RemoveIndexed(ctx, value)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Close is to implement Store.Close().
+func (s *shardedInMemStore) Close() {
+	close(s.closeTicker)
+	saveOnClose(s.snapshot, s.journal)
+}
+
+// attrChanged journals the attribute change of the session and updates its estimated size,
+// if it is in the store.
+func (s *shardedInMemStore) attrChanged(sess Session, name string, old, new interface{}) {
+	s.shard(sess.ID()).attrChanged(sess, name, old, new)
+}
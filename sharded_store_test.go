@@ -0,0 +1,198 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// shardLen returns the number of sessions in the shard.
+func shardLen(sh *inMemStore) int {
+	sh.mux.RLock()
+	defer sh.mux.RUnlock()
+	return len(sh.sessions)
+}
+
+func TestShardedInMemStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	ctx := context.Background()
+
+	l := &recordingListener{}
+	st := NewInMemStoreOptions(&InMemStoreOptions{
+		SessCleanerInterval: 20 * time.Millisecond,
+		Logger:              NoopLogger,
+		Listeners:           []EventListener{l},
+		IndexCAttr:          "UserName",
+		Shards:              4,
+	})
+	defer st.Close()
+	sst := st.(*shardedInMemStore)
+	eq(4, len(sst.shards))
+
+	var sessions []Session
+	for i := 0; i < 100; i++ {
+		s := NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"UserName": "bob"}})
+		st.Add(s)
+		sessions = append(sessions, s)
+	}
+	for _, s := range sessions {
+		eq(s, st.Get(s.ID()))
+	}
+	for _, sh := range sst.shards {
+		neq(0, shardLen(sh)) // Sessions are distributed among the shards
+	}
+
+	indexed, err := st.(IndexedStore).IndexedSessions(ctx, "bob")
+	eq(nil, err)
+	eq(true, reflect.DeepEqual(sessions, indexed))
+
+	s2, err := st.(Regenerator).Regenerate(ctx, sessions[0])
+	eq(nil, err)
+	eq(nil, st.Get(sessions[0].ID()))
+	eq(s2, st.Get(s2.ID()))
+
+	st.Remove(s2)
+	eq(nil, st.Get(s2.ID()))
+	n, err := st.(IndexedStore).RemoveIndexed(ctx, "bob")
+	eq(nil, err)
+	eq(99, n)
+	l.take()
+
+	// All shards are swept:
+	for i := 0; i < 20; i++ {
+		st.Add(NewSessionOptions(&SessOptions{Timeout: 10 * time.Millisecond}))
+	}
+	l.take()
+	time.Sleep(80 * time.Millisecond)
+	eq(20, len(l.take()))
+	for _, sh := range sst.shards {
+		eq(0, shardLen(sh))
+	}
+}
+
+func TestShardedInMemStoreRegenerateRevoked(t *testing.T) {
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, Shards: 4})
+	defer st.Close()
+
+	testRegenerateRevoked(t, st)
+}
+
+func TestShardedInMemStoreBounds(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	total := func(st Store) (n int) {
+		for _, sh := range st.(*shardedInMemStore).shards {
+			n += shardLen(sh)
+		}
+		return
+	}
+
+	// Bounds are divided among the shards, each evicting its own least recently accessed sessions:
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, MaxSessions: 10, Shards: 4})
+	defer st.Close()
+	sst := st.(*shardedInMemStore)
+	byShard := map[*inMemStore][]Session{}
+	for i := 0; i < 100; i++ {
+		s := NewSession()
+		st.Add(s)
+		byShard[sst.shard(s.ID())] = append(byShard[sst.shard(s.ID())], s)
+	}
+	eq(10, total(st))
+	for sh, sessions := range byShard {
+		kept := len(sessions) - int(sh.bound.maxSessions)
+		for i, s := range sessions {
+			if i < kept {
+				eq(nil, st.Get(s.ID()))
+			} else {
+				eq(s, st.Get(s.ID()))
+			}
+		}
+	}
+
+	// The shard of a regenerated session evicts too:
+	for _, sessions := range byShard {
+		_, err := st.(Regenerator).Regenerate(context.Background(), sessions[len(sessions)-1])
+		eq(nil, err)
+	}
+	eq(true, total(st) <= 10)
+
+	// No more shards than sessions allowed:
+	st2 := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, MaxSessions: 3, Shards: 8})
+	defer st2.Close()
+	eq(3, len(st2.(*shardedInMemStore).shards))
+	for i := 0; i < 100; i++ {
+		st2.Add(NewSession())
+	}
+	eq(3, total(st2))
+
+	st3 := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, MaxSessions: 1, Shards: 8})
+	defer st3.Close()
+	_, sharded := st3.(*shardedInMemStore)
+	eq(false, sharded)
+}
+
+// benchmarkStore measures concurrent Get calls mixed with Add calls (1 in every 16 operations).
+func benchmarkStore(b *testing.B, o *InMemStoreOptions) {
+	o.Logger = NoopLogger
+	st := NewInMemStoreOptions(o)
+	defer st.Close()
+
+	ids := make([]string, 10000)
+	for i := range ids {
+		s := NewSession()
+		st.Add(s)
+		ids[i] = s.ID()
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%16 == 0 {
+				st.Add(NewSession())
+			} else {
+				st.Get(ids[i%len(ids)])
+			}
+		}
+	})
+}
+
+func BenchmarkInMemStore(b *testing.B) {
+	benchmarkStore(b, &InMemStoreOptions{})
+}
+
+func BenchmarkInMemStoreBounded(b *testing.B) {
+	benchmarkStore(b, &InMemStoreOptions{MaxSessions: 20000})
+}
+
+func BenchmarkShardedInMemStore(b *testing.B) {
+	for _, shards := range []int{4, 16, 64} {
+		b.Run(fmt.Sprint("shards=", shards), func(b *testing.B) {
+			benchmarkStore(b, &InMemStoreOptions{Shards: shards})
+		})
+	}
+}
+
+func BenchmarkShardedInMemStoreBounded(b *testing.B) {
+	benchmarkStore(b, &InMemStoreOptions{MaxSessions: 20000, Shards: 16})
+}
+
+// BenchmarkShardedInMemStoreBoundedAdd measures concurrent Add calls to a full sharded store,
+// each of which evicts a session.
+func BenchmarkShardedInMemStoreBoundedAdd(b *testing.B) {
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, MaxSessions: 20000, Shards: 16})
+	defer st.Close()
+	for i := 0; i < 20000; i++ {
+		st.Add(NewSession())
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			st.Add(NewSession())
+		}
+	})
+}
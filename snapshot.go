@@ -0,0 +1,288 @@
+/*
+
+Snapshots of the in-memory session store.
+
+*/
+
+package session
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrInvalidSnapshot is returned by SnapshotStore.Restore() if the data is not a snapshot
+// or it is truncated.
+var ErrInvalidSnapshot = errors.New("session: invalid snapshot")
+
+// snapshotHeader starts snapshots, the last byte being the version of the format.
+//
+// The header is followed by sessions marshaled with MarshalSession(), each prefixed by its length
+// as an uvarint. The end of the snapshot is marked by a zero length, so truncated snapshots can be detected.
+const snapshotHeader = "SESSNAP\x01"
+
+// maxSnapshotRecord is the max accepted size of a marshaled session in a snapshot.
+const maxSnapshotRecord = 64 << 20
+
+// writeSnapshot writes a snapshot of the sessions to w, encoded with codec.
+// Expired sessions are skipped.
+func writeSnapshot(w io.Writer, sessions []Session, codec Codec) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotHeader)
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	now := time.Now()
+	for _, sess := range sessions {
+		if expired(sess, now) {
+			continue
+		}
+		data, err := MarshalSession(sess, codec)
+		if err != nil {
+			return err
+		}
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(data)))])
+		bw.Write(data)
+	}
+	bw.WriteByte(0)
+
+	return bw.Flush()
+}
+
+// readSnapshot reads the sessions of a snapshot written by writeSnapshot().
+func readSnapshot(r io.Reader) ([]Session, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(snapshotHeader))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != snapshotHeader {
+		return nil, ErrInvalidSnapshot
+	}
+
+	var sessions []Session
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size > maxSnapshotRecord {
+			return nil, ErrInvalidSnapshot
+		}
+		if size == 0 {
+			return sessions, nil
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, ErrInvalidSnapshot
+		}
+		sess, err := UnmarshalSession(data)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+}
+
+// snapshotStore is a SnapshotStore which can also add restored sessions directly.
+type snapshotStore interface {
+	SnapshotStore
+
+	// restore adds the restored sessions to the store, except the expired ones which are reported as expired.
+	restore(sessions []Session)
+}
+
+// Snapshot is to implement SnapshotStore.Snapshot().
+func (s *inMemStore) Snapshot(w io.Writer) error {
+	return writeSnapshot(w, s.all(), s.codec)
+}
+
+// all returns all sessions of the store.
+func (s *inMemStore) all() []Session {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// Restore is to implement SnapshotStore.Restore().
+func (s *inMemStore) Restore(r io.Reader) error {
+	sessions, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	s.restore(sessions)
+	s.journal.commit()
+	return nil
+}
+
+// restore adds the restored sessions to the store, except the expired ones which are reported as expired.
+func (s *inMemStore) restore(sessions []Session) {
+	var expiredSessions, evicted []Session
+	func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+
+		now := time.Now()
+		for _, sess := range sessions {
+			if expired(sess, now) {
+				s.logger.expired(sess.ID(), sess)
+				expiredSessions = append(expiredSessions, sess)
+				continue
+			}
+			s.put(sess)
+		}
+		evicted = s.evict()
+	}()
+
+	for _, sess := range expiredSessions {
+		s.listeners.expired(sess)
+	}
+	for _, sess := range evicted {
+		s.listeners.removed(sess)
+	}
+}
+
+// Snapshot is to implement SnapshotStore.Snapshot().
+func (s *shardedInMemStore) Snapshot(w io.Writer) error {
+	var sessions []Session
+	for _, sh := range s.shards {
+		sessions = append(sessions, sh.all()...)
+	}
+	return writeSnapshot(w, sessions, s.shards[0].codec)
+}
+
+// Restore is to implement SnapshotStore.Restore().
+func (s *shardedInMemStore) Restore(r io.Reader) error {
+	sessions, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	s.restore(sessions)
+	s.journal.commit()
+	return nil
+}
+
+// restore adds the restored sessions to their shards.
+func (s *shardedInMemStore) restore(sessions []Session) {
+	byShard := make(map[*inMemStore][]Session, len(s.shards))
+	for _, sess := range sessions {
+		sh := s.shard(sess.ID())
+		byShard[sh] = append(byShard[sh], sess)
+	}
+	for sh, sessions := range byShard {
+		sh.restore(sessions)
+	}
+}
+
+// snapshotFile saves snapshots of a store to a file, and restores the store from it.
+// Methods may be called on a nil value, which means snapshots are disabled.
+type snapshotFile struct {
+	name   string        // Name of the snapshot file
+	st     snapshotStore // Store to snapshot
+	logger *sessLogger   // Logger to log errors with
+
+	// mux serializes saving snapshots, so an older snapshot cannot overwrite a newer one.
+	mux sync.Mutex
+}
+
+// newSnapshotFile returns a new snapshotFile, nil if name is empty.
+func newSnapshotFile(name string, st snapshotStore, logger *sessLogger) *snapshotFile {
+	if name == "" {
+		return nil
+	}
+	return &snapshotFile{name: name, st: st, logger: logger}
+}
+
+// restore restores the store from the snapshot file, if it exists.
+func (f *snapshotFile) restore() {
+	if f == nil {
+		return
+	}
+	sessions, err := f.load()
+	if err != nil {
+		f.logger.error("Failed to restore snapshot", err)
+		return
+	}
+	f.st.restore(sessions)
+}
+
+// load reads the sessions of the snapshot file, nil if it does not exist.
+func (f *snapshotFile) load() ([]Session, error) {
+	if f == nil {
+		return nil, nil
+	}
+	file, err := os.Open(f.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	return readSnapshot(file)
+}
+
+// run saves a snapshot periodically until done is closed.
+// This method is to be started as a new goroutine.
+func (f *snapshotFile) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-done:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			f.save()
+		}
+	}
+}
+
+// save saves a snapshot of the store to the snapshot file atomically:
+// the snapshot is written to a temporary file first which is then renamed.
+// Errors are logged, and also returned.
+func (f *snapshotFile) save() error {
+	if f == nil {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	err := f.write()
+	if err != nil {
+		f.logger.error("Failed to save snapshot", err)
+	}
+	return err
+}
+
+// write writes a snapshot of the store to a temporary file, and renames it to the snapshot file.
+func (f *snapshotFile) write() (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(f.name), ".tmp-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = f.st.Snapshot(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.name)
+}
@@ -0,0 +1,83 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	s := NewSessionOptions(&SessOptions{CAttrs: map[string]interface{}{"UserName": "bob"}, Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	buf := &bytes.Buffer{}
+	eq(nil, st.(SnapshotStore).Snapshot(buf))
+	st.Close()
+
+	for _, shards := range []int{0, 4} {
+		st2 := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, IndexCAttr: "UserName", Shards: shards})
+		eq(nil, st2.(SnapshotStore).Restore(bytes.NewReader(buf.Bytes())))
+		s2 := st2.Get(s.ID())
+		neq(nil, s2)
+		eq(1, s2.Attr("a"))
+		eq("bob", s2.CAttr("UserName"))
+		eq(s.Created().UnixNano(), s2.Created().UnixNano())
+
+		sessions, _ := st2.(IndexedStore).IndexedSessions(context.Background(), "bob")
+		eq(1, len(sessions))
+		st2.Close()
+	}
+
+	// Invalid snapshots:
+	st = NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+	eq(ErrInvalidSnapshot, st.(SnapshotStore).Restore(bytes.NewReader([]byte("foo"))))
+	eq(ErrInvalidSnapshot, st.(SnapshotStore).Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-1])))
+	eq(nil, st.Get(s.ID()))
+}
+
+func TestSnapshotFile(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	name := filepath.Join(t.TempDir(), "sessions.snap")
+	o := &InMemStoreOptions{Logger: NoopLogger, SnapshotFile: name}
+
+	st := NewInMemStoreOptions(o)
+	s := NewSession()
+	short := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(s)
+	st.Add(short)
+	st.Close() // Saves a snapshot
+
+	// Sessions that expired while the store was down are reported:
+	time.Sleep(40 * time.Millisecond)
+	l := &recordingListener{}
+	o.Listeners = []EventListener{l}
+	st = NewInMemStoreOptions(o)
+	eq(true, reflect.DeepEqual([]string{"expired:" + short.ID()}, l.take()))
+	neq(nil, st.Get(s.ID()))
+	eq(nil, st.Get(short.ID()))
+	st.Close()
+
+	// Periodic snapshots:
+	o.Listeners = nil
+	o.SnapshotInterval = 10 * time.Millisecond
+	o.Shards = 4
+	st = NewInMemStoreOptions(o)
+	defer st.Close()
+	s2 := NewSession()
+	st.Add(s2)
+	time.Sleep(40 * time.Millisecond)
+
+	st2 := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger, SnapshotFile: name})
+	defer st2.Close()
+	neq(nil, st2.Get(s.ID()))
+	neq(nil, st2.Get(s2.ID()))
+}
@@ -0,0 +1,516 @@
+/*
+
+A database/sql based session store implementation.
+
+*/
+
+package session
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// database/sql based session Store implementation.
+// Sessions are stored in a single table, one row per session.
+// Session data is encoded using a Codec, last accessed and expiration times
+// are stored in separate columns so they can be updated / queried without decoding the data.
+// The version of the session (Session.Version()) is also stored in a separate column
+// to support optimistic concurrency control.
+type sqlStore struct {
+	db          *sql.DB         // Database handle
+	q           sqlQueries      // Queries to use, built for the table and placeholder style
+	closeTicker chan struct{}   // Channel to signal close for the session cleaner
+	codec       Codec           // Codec to encode sessions with
+	logger      *sessLogger     // Logger of session lifecycle events and errors
+	listeners   *eventListeners // Listeners to notify about session lifecycle events
+}
+
+// sqlQueries holds the SQL statements used by sqlStore.
+type sqlQueries struct {
+	get, touch, insert, update, save, remove, removeLive, sweep string
+
+	// Queries used by the session cleaner if there are listeners to notify about expired sessions
+	selectExpired, removeExpired string
+}
+
+// SQLStoreOptions defines options that may be passed when creating a new database/sql based Store.
+// All fields are optional; default value will be used for any field that has the zero value.
+type SQLStoreOptions struct {
+	// Name of the table to store sessions in, default is "sessions".
+	// The store also creates a table named TableName+"_schema" to keep track of the schema version.
+	// The name is used in SQL statements as-is, so it must be a valid identifier.
+	TableName string
+
+	// SQL type of the column holding the encoded session data, default is "BLOB".
+	// Use e.g. "BYTEA" for PostgreSQL.
+	BlobType string
+
+	// Placeholder returns the parameter placeholder for the i-th (1-based) parameter
+	// of a statement. Default is to use "?" for all parameters (SQLite, MySQL).
+	// For PostgreSQL you may use DollarPlaceholder.
+	Placeholder func(i int) string
+
+	// Session cleaner check interval, default is 10 seconds.
+	SessCleanerInterval time.Duration
+
+	// Codec to encode sessions with, default is GobCodec.
+	// Sessions encoded with other registered codecs (see RegisterCodec()) can also be decoded,
+	// so the codec may be changed without losing existing sessions.
+	Codec Codec
+
+	// Logger to log session lifecycle events (e.g. added, removed, timed out) and errors.
+	// Default is to use the global functions of the log package.
+	// To disable logging, you may use NoopLogger.
+	Logger *log.Logger
+
+	// Handler to emit structured log records of session lifecycle events and errors with (see LogEvent),
+	// default is none. If set, Logger is not used.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+
+	// Listeners to notify about session lifecycle events, default is none.
+	// To report expired sessions, the session cleaner has to load and delete them one by one.
+	Listeners []EventListener
+}
+
+// DollarPlaceholder is a SQLStoreOptions.Placeholder that produces numbered
+// placeholders like "$1", "$2" (e.g. PostgreSQL).
+func DollarPlaceholder(i int) string {
+	return "$" + strconv.Itoa(i)
+}
+
+// Pointer to zero value of SQLStoreOptions to be reused for efficiency.
+var zeroSQLStoreOptions = new(SQLStoreOptions)
+
+// sqlMigrations are the steps to create / migrate the sessions table.
+// The schema version is the number of applied steps.
+// Steps must never be changed once released, only new steps may be appended.
+// {{table}} and {{blob}} are substituted with the table name and the blob type.
+var sqlMigrations = []string{
+	`CREATE TABLE {{table}} (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		data {{blob}} NOT NULL,
+		accessed BIGINT NOT NULL,
+		expires BIGINT NOT NULL
+	)`,
+	`CREATE INDEX {{table}}_expires ON {{table}} (expires)`,
+	`ALTER TABLE {{table}} ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+}
+
+// NewSQLStore returns a new, database/sql based session Store with the default options.
+// Default values of options are listed in the SQLStoreOptions type.
+// See NewSQLStoreOptions() for details.
+func NewSQLStore(db *sql.DB) (Store, error) {
+	return NewSQLStoreOptions(db, zeroSQLStoreOptions)
+}
+
+// NewSQLStoreOptions returns a new, database/sql based session Store with the specified options.
+// The sessions table is created or migrated to the latest schema version if needed.
+//
+// The session's last accessed time is updated in the database on each Store.Get(),
+// but changes made to a session (e.g. Session.SetAttr()) are not persisted automatically:
+// to save them, call Store.Add() (or Manager.Add()) again with the session, or use
+// the Middleware which saves modified sessions at the end of requests (see Saver).
+//
+// Only sessions created by this package (NewSession() and NewSessionOptions()) can be stored.
+// Sessions are encoded using the codec specified in the options (GobCodec by default),
+// types of attribute values must be registered with the codec (e.g. gob.Register() for GobCodec).
+//
+// The returned Store has an automatic session cleaner which runs
+// in its own goroutine, and deletes rows of expired sessions.
+// Closing the Store does not close db.
+//
+// The returned Store also implements StoreCtx, which reports failures of the operations,
+// VersionedStore, so sessions can be modified safely using UpdateInStore(), and Saver.
+func NewSQLStoreOptions(db *sql.DB, o *SQLStoreOptions) (Store, error) {
+	table := o.TableName
+	if table == "" {
+		table = "sessions"
+	}
+	blob := o.BlobType
+	if blob == "" {
+		blob = "BLOB"
+	}
+	ph := o.Placeholder
+	if ph == nil {
+		ph = func(int) string { return "?" }
+	}
+
+	if err := sqlMigrate(db, table, blob, ph); err != nil {
+		return nil, fmt.Errorf("session: failed to migrate table %s: %w", table, err)
+	}
+
+	s := &sqlStore{
+		db: db,
+		q: sqlQueries{
+			get:    fmt.Sprintf("SELECT data, accessed FROM %s WHERE id=%s AND expires>%s", table, ph(1), ph(2)),
+			touch:  fmt.Sprintf("UPDATE %s SET accessed=%s, expires=%s WHERE id=%s AND expires>%s", table, ph(1), ph(2), ph(3), ph(4)),
+			insert: fmt.Sprintf("INSERT INTO %s (id, data, accessed, expires, version) VALUES (%s, %s, %s, %s, %s)", table, ph(1), ph(2), ph(3), ph(4), ph(5)),
+			update: fmt.Sprintf("UPDATE %s SET data=%s, accessed=%s, expires=%s, version=%s WHERE id=%s AND version=%s AND expires>%s",
+				table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6), ph(7)),
+			save: fmt.Sprintf("UPDATE %s SET data=%s, accessed=%s, expires=%s, version=%s WHERE id=%s AND expires>%s",
+				table, ph(1), ph(2), ph(3), ph(4), ph(5), ph(6)),
+			remove:     fmt.Sprintf("DELETE FROM %s WHERE id=%s", table, ph(1)),
+			removeLive: fmt.Sprintf("DELETE FROM %s WHERE id=%s AND expires>%s", table, ph(1), ph(2)),
+			sweep:      fmt.Sprintf("DELETE FROM %s WHERE expires<=%s", table, ph(1)),
+
+			selectExpired: fmt.Sprintf("SELECT id, data FROM %s WHERE expires<=%s", table, ph(1)),
+			removeExpired: fmt.Sprintf("DELETE FROM %s WHERE id=%s AND expires<=%s", table, ph(1), ph(2)),
+		},
+		closeTicker: make(chan struct{}),
+		logger:      newSessLogger(o.Logger, o.LogHandler, o.LogLevels),
+		codec:       o.Codec,
+		listeners:   newEventListeners(o.Listeners),
+	}
+
+	if s.codec == nil {
+		s.codec = GobCodec{}
+	}
+
+	interval := o.SessCleanerInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	go s.sessCleaner(interval)
+
+	return s, nil
+}
+
+// sqlMigrate creates or migrates the sessions table to the latest schema version.
+//
+// Multiple instances may start at the same time: each migration step runs in its own transaction
+// which locks the version row before reading it, so each step is applied only once.
+// Note that some databases (e.g. MySQL) commit DDL statements implicitly.
+func sqlMigrate(db *sql.DB, table, blob string, ph func(int) string) error {
+	schemaTable := table + "_schema"
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER NOT NULL PRIMARY KEY, version INTEGER NOT NULL)", schemaTable)); err != nil {
+		return err
+	}
+
+	// Create the version row. The primary key makes sure only one is created,
+	// so a failing insert is not an error if the row exists (created by another instance).
+	if _, err := db.Exec(fmt.Sprintf("INSERT INTO %s (id, version) VALUES (1, 0)", schemaTable)); err != nil {
+		var count int
+		if err2 := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", schemaTable)).Scan(&count); err2 != nil || count == 0 {
+			return err
+		}
+	}
+
+	r := strings.NewReplacer("{{table}}", table, "{{blob}}", blob)
+	for done := false; !done; {
+		var version int
+		err := func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			// Lock the version row with a no-op update (SELECT ... FOR UPDATE is not portable):
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET version=version WHERE id=1", schemaTable)); err != nil {
+				return err
+			}
+			if err := tx.QueryRow(fmt.Sprintf("SELECT version FROM %s WHERE id=1", schemaTable)).Scan(&version); err != nil {
+				return err
+			}
+			if done = version >= len(sqlMigrations); done {
+				return nil
+			}
+
+			if _, err := tx.Exec(r.Replace(sqlMigrations[version])); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET version=%s WHERE id=1", schemaTable, ph(1)), version+1); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return fmt.Errorf("migration step %d: %w", version+1, err)
+		}
+	}
+
+	return nil
+}
+
+// sessCleaner periodically deletes timed out sessions
+// in an endless loop.
+// This method is to be started as a new goroutine.
+func (s *sqlStore) sessCleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-s.closeTicker:
+			// We are being shut down...
+			ticker.Stop()
+			return
+		case now := <-ticker.C:
+			if s.listeners != nil {
+				s.sweepNotify(now)
+				continue
+			}
+			res, err := s.db.Exec(s.q.sweep, now.UnixNano())
+			if err != nil {
+				s.logger.error("Failed to delete timed out sessions", err)
+				continue
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				s.logger.expiredCount(n)
+			}
+		}
+	}
+}
+
+// sweepNotify deletes the sessions expired by now one by one,
+// and notifies the listeners about the ones it deleted.
+func (s *sqlStore) sweepNotify(now time.Time) {
+	type row struct {
+		id   string
+		data []byte
+	}
+	var rows []row
+
+	err := func() error {
+		rs, err := s.db.Query(s.q.selectExpired, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		defer rs.Close()
+		for rs.Next() {
+			var r row
+			if err := rs.Scan(&r.id, &r.data); err != nil {
+				return err
+			}
+			rows = append(rows, r)
+		}
+		return rs.Err()
+	}()
+	if err != nil {
+		s.logger.error("Failed to query timed out sessions", err)
+		return
+	}
+
+	for _, r := range rows {
+		// Session might have been accessed or removed since it was queried:
+		res, err := s.db.Exec(s.q.removeExpired, r.id, now.UnixNano())
+		if err != nil {
+			s.logger.error("Failed to delete timed out session", err, r.id)
+			continue
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		sess, err := decodeSession(r.data, s.codec)
+		if err != nil {
+			s.logger.expired(r.id, nil)
+			s.logger.error("Failed to decode timed out session", err, r.id)
+			continue
+		}
+		s.logger.expired(r.id, sess)
+		s.listeners.expired(sess)
+	}
+}
+
+// GetCtx is to implement StoreCtx.GetCtx().
+func (s *sqlStore) GetCtx(ctx context.Context, id string) (Session, error) {
+	var (
+		data     []byte
+		accessed int64
+	)
+	now := time.Now()
+	err := s.db.QueryRowContext(ctx, s.q.get, id, now.UnixNano()).Scan(&data, &accessed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := decodeSession(data, s.codec)
+	if err != nil {
+		return nil, err
+	}
+	// Only the accessed column is kept up-to-date:
+	sess.(*sessionImpl).AccessedF = time.Unix(0, accessed)
+
+	sess.Access()
+	_, err = s.db.ExecContext(ctx, s.q.touch, sess.Accessed().UnixNano(), expiresAt(sess).UnixNano(), id, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.accessed(sess)
+	s.listeners.accessed(sess)
+	return sess, nil
+}
+
+// AddCtx is to implement StoreCtx.AddCtx().
+// The row of the session is replaced if it already exists.
+func (s *sqlStore) AddCtx(ctx context.Context, sess Session) error {
+	s.logger.added(sess)
+
+	if err := s.replace(ctx, sess, sess, false); err != nil {
+		return err
+	}
+	s.listeners.added(sess)
+	return nil
+}
+
+// replace deletes the row of old, and inserts sess in one transaction.
+// If mustExist is true, ErrSessionNotFound is returned if old is not in the store (or it has expired).
+func (s *sqlStore) replace(ctx context.Context, old, sess Session, mustExist bool) error {
+	version := sess.Version()
+	data, err := MarshalSession(sess, s.codec)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// DELETE + INSERT is portable, unlike "upsert" statements.
+	if mustExist {
+		res, err := tx.ExecContext(ctx, s.q.removeLive, old.ID(), time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrSessionNotFound
+		}
+	} else if _, err := tx.ExecContext(ctx, s.q.remove, old.ID()); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.q.insert, sess.ID(), data, sess.Accessed().UnixNano(), expiresAt(sess).UnixNano(),
+		int64(version))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	sess.MarkSaved(version)
+	return nil
+}
+
+// SaveIfVersion is to implement VersionedStore.SaveIfVersion().
+func (s *sqlStore) SaveIfVersion(ctx context.Context, sess Session, version uint64) error {
+	newVersion := sess.Version()
+	data, err := MarshalSession(sess, s.codec)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, s.q.update, data, sess.Accessed().UnixNano(), expiresAt(sess).UnixNano(),
+		int64(newVersion), sess.ID(), int64(version), time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVersionConflict
+	}
+	sess.MarkSaved(newVersion)
+	return nil
+}
+
+// Save is to implement Saver.Save().
+// Only the row of the session is updated, so removed or expired sessions are not resurrected.
+func (s *sqlStore) Save(ctx context.Context, sess Session) error {
+	if !dirty(sess) {
+		_, err := s.db.ExecContext(ctx, s.q.touch, sess.Accessed().UnixNano(), expiresAt(sess).UnixNano(), sess.ID(),
+			time.Now().UnixNano())
+		return err
+	}
+
+	version := sess.Version()
+	data, err := MarshalSession(sess, s.codec)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.q.save, data, sess.Accessed().UnixNano(), expiresAt(sess).UnixNano(),
+		int64(version), sess.ID(), time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	sess.MarkSaved(version)
+	return nil
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+func (s *sqlStore) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.replace(ctx, sess, sess2, true); err != nil {
+		return nil, err
+	}
+	s.logger.regenerated(sess, sess2)
+	s.listeners.removed(sess)
+	s.listeners.created(sess2)
+	return sess2, nil
+}
+
+// RemoveCtx is to implement StoreCtx.RemoveCtx().
+func (s *sqlStore) RemoveCtx(ctx context.Context, sess Session) error {
+	s.logger.removed(sess)
+	res, err := s.db.ExecContext(ctx, s.q.remove, sess.ID())
+	if err != nil {
+		return err
+	}
+	if s.listeners != nil {
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			s.listeners.removed(sess)
+		}
+	}
+	return nil
+}
+
+// Get is to implement Store.Get().
+func (s *sqlStore) Get(id string) Session {
+	sess, err := s.GetCtx(context.Background(), id)
+	if err != nil {
+		s.logger.error("Failed to get session", err, id)
+		return nil
+	}
+	return sess
+}
+
+// Add is to implement Store.Add().
+func (s *sqlStore) Add(sess Session) {
+	if err := s.AddCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to add session", err, sess.ID())
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (s *sqlStore) Remove(sess Session) {
+	if err := s.RemoveCtx(context.Background(), sess); err != nil {
+		s.logger.error("Failed to remove session", err, sess.ID())
+	}
+}
+
+// Close is to implement Store.Close().
+func (s *sqlStore) Close() {
+	close(s.closeTicker)
+}
@@ -0,0 +1,9 @@
+/*
+
+Package sqlitetest tests the database/sql based session store of package session with SQLite.
+
+It is a separate module so that the cgo based SQLite driver is not a dependency of package session.
+
+*/
+
+package sqlitetest
@@ -0,0 +1,11 @@
+module github.com/icza/session/sqlitetest
+
+go 1.23.0
+
+require (
+	github.com/icza/mighty v0.0.0-20230330133200-c4b03a294ed8
+	github.com/icza/session v0.0.0
+	github.com/mattn/go-sqlite3 v1.14.33
+)
+
+replace github.com/icza/session => ../
@@ -0,0 +1,359 @@
+package sqlitetest
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+	"github.com/icza/session"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sessions.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+
+	db := openTestDB(t)
+	st, err := session.NewSQLStoreOptions(db, &session.SQLStoreOptions{Logger: session.NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+
+	eq(nil, st.Get("asdf"))
+
+	s := session.NewSessionOptions(&session.SessOptions{
+		CAttrs: map[string]interface{}{"ca": "x"},
+		Attrs:  map[string]interface{}{"a": 1},
+	})
+	st.Add(s)
+	time.Sleep(10 * time.Millisecond)
+
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(s.ID(), s2.ID())
+	neq(s2.Accessed(), s2.Created())
+	eq("x", s2.CAttr("ca"))
+	eq(1, s2.Attr("a"))
+
+	// Changes are persisted by adding the session again:
+	s2.SetAttr("b", "y")
+	st.Add(s2)
+	s3 := st.Get(s.ID())
+	eq("y", s3.Attr("b"))
+	eq(false, s3.Accessed().Before(s2.Accessed()))
+
+	s4, err := st.(session.Regenerator).Regenerate(context.Background(), s3)
+	eq(nil, err)
+	neq(s.ID(), s4.ID())
+	eq(nil, st.Get(s.ID()))
+	eq("y", st.Get(s4.ID()).Attr("b"))
+
+	st.Remove(s4)
+	eq(nil, st.Get(s4.ID()))
+}
+
+func TestSQLStoreRegenerateRevoked(t *testing.T) {
+	eq, neq := mighty.EqNeq(t)
+	ctx := context.Background()
+
+	st, err := session.NewSQLStoreOptions(openTestDB(t), &session.SQLStoreOptions{Logger: session.NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+	r := st.(session.Regenerator)
+
+	// Removed and expired sessions cannot be regenerated:
+	s := session.NewSession()
+	st.Add(s)
+	st.Remove(s)
+	_, err = r.Regenerate(ctx, s)
+	eq(session.ErrSessionNotFound, err)
+
+	short := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(short)
+	time.Sleep(40 * time.Millisecond)
+	_, err = r.Regenerate(ctx, short)
+	eq(session.ErrSessionNotFound, err)
+
+	s = session.NewSession()
+	st.Add(s)
+	s2, err := r.Regenerate(ctx, s)
+	eq(nil, err)
+	neq(nil, st.Get(s2.ID()))
+}
+
+func TestSQLStoreMigrate(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openTestDB(t)
+	o := &session.SQLStoreOptions{TableName: "sess", Logger: session.NoopLogger}
+	st, err := session.NewSQLStoreOptions(db, o)
+	eq(nil, err)
+	s := session.NewSession()
+	st.Add(s)
+	st.Close()
+
+	var version int
+	eq(nil, db.QueryRow("SELECT version FROM sess_schema").Scan(&version))
+
+	// Opening again must not fail, and must keep existing sessions and the schema version:
+	st, err = session.NewSQLStoreOptions(db, o)
+	eq(nil, err)
+	defer st.Close()
+	eq(s.ID(), st.Get(s.ID()).ID())
+
+	var version2, rows int
+	eq(nil, db.QueryRow("SELECT version FROM sess_schema").Scan(&version2))
+	eq(version, version2)
+	eq(nil, db.QueryRow("SELECT COUNT(*) FROM sess_schema").Scan(&rows))
+	eq(1, rows)
+}
+
+func TestSQLStoreMigrateConcurrent(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openTestDB(t)
+	o := &session.SQLStoreOptions{Logger: session.NoopLogger}
+
+	// Instances starting at the same time must apply each migration step once:
+	const instances = 4
+	errs := make([]error, instances)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := session.NewSQLStoreOptions(db, o)
+			if err == nil {
+				st.Close()
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		eq(nil, err)
+	}
+
+	var rows int
+	eq(nil, db.QueryRow("SELECT COUNT(*) FROM sessions_schema").Scan(&rows))
+	eq(1, rows)
+}
+
+func TestSQLStoreSessCleaner(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openTestDB(t)
+	st, err := session.NewSQLStoreOptions(db, &session.SQLStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              session.NoopLogger,
+	})
+	eq(nil, err)
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 50 * time.Millisecond})
+	st.Add(s)
+	eq(s.ID(), st.Get(s.ID()).ID())
+
+	time.Sleep(30 * time.Millisecond)
+	eq(s.ID(), st.Get(s.ID()).ID())
+
+	time.Sleep(80 * time.Millisecond)
+	var count int
+	eq(nil, db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count))
+	eq(0, count)
+}
+
+// recordingListener is an EventListener which records the events it receives.
+type recordingListener struct {
+	session.NoopEventListener
+	mux    sync.Mutex
+	events []string
+}
+
+func (l *recordingListener) record(event string, sess session.Session) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.events = append(l.events, event+":"+sess.ID())
+}
+
+func (l *recordingListener) OnCreated(sess session.Session) { l.record("created", sess) }
+func (l *recordingListener) OnRemoved(sess session.Session) { l.record("removed", sess) }
+func (l *recordingListener) OnExpired(sess session.Session) { l.record("expired", sess) }
+
+// take returns the recorded events, and clears them.
+func (l *recordingListener) take() []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	events := l.events
+	l.events = nil
+	return events
+}
+
+func TestSQLStoreListenersExpired(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	l := &recordingListener{}
+	st, err := session.NewSQLStoreOptions(openTestDB(t), &session.SQLStoreOptions{
+		SessCleanerInterval: 10 * time.Millisecond,
+		Logger:              session.NoopLogger,
+		Listeners:           []session.EventListener{l},
+	})
+	eq(nil, err)
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(s)
+	st.Remove(session.NewSession()) // Not in the store
+	time.Sleep(60 * time.Millisecond)
+	eq(true, reflect.DeepEqual([]string{"created:" + s.ID(), "expired:" + s.ID()}, l.take()))
+}
+
+func TestSQLStoreVersioned(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	db := openTestDB(t)
+	st, err := session.NewSQLStoreOptions(db, &session.SQLStoreOptions{Logger: session.NoopLogger})
+	eq(nil, err)
+	defer st.Close()
+
+	s := session.NewSessionOptions(&session.SessOptions{Attrs: map[string]interface{}{"count": 0}})
+	st.Add(s)
+
+	testVersionedStore(t, st.(session.StoreCtx), s.ID())
+
+	// Session values are decoded on each access, so stale values are rejected:
+	ctx := context.Background()
+	s1, _ := st.(session.StoreCtx).GetCtx(ctx, s.ID())
+	s2, _ := st.(session.StoreCtx).GetCtx(ctx, s.ID())
+	v := s1.Version()
+	s1.SetAttr("a", 1)
+	eq(nil, st.(session.VersionedStore).SaveIfVersion(ctx, s1, v))
+	s2.SetAttr("a", 2)
+	eq(session.ErrVersionConflict, st.(session.VersionedStore).SaveIfVersion(ctx, s2, v))
+	eq(1, st.Get(s.ID()).Attr("a"))
+
+	st.Remove(s)
+	eq(session.ErrVersionConflict, st.(session.VersionedStore).SaveIfVersion(ctx, s1, s1.Version()))
+}
+
+func TestSQLStoreSave(t *testing.T) {
+	db := openTestDB(t)
+	st, err := session.NewSQLStoreOptions(db, &session.SQLStoreOptions{Logger: session.NoopLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	testSaver(t, st)
+}
+
+func TestSQLStoreMiddlewareSave(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st, err := session.NewSQLStoreOptions(openTestDB(t), &session.SQLStoreOptions{Logger: session.NoopLogger})
+	eq(nil, err)
+	mgr := session.NewCookieManagerOptions(st, &session.CookieMngrOptions{AllowHTTP: true})
+	defer mgr.Close()
+
+	h := session.MiddlewareOptions(mgr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess := session.FromContext(r.Context())
+		sess.SetAttr("a", sess.Attr("a").(int)+1)
+		w.Write([]byte(sess.ID()))
+	}), &session.MwOptions{LazyCreate: true, SessOptions: &session.SessOptions{Attrs: map[string]interface{}{"a": 0}}})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	c := w.Result().Cookies()[0]
+	id := w.Body.String()
+	eq(1, st.Get(id).Attr("a"))
+
+	// Modifications of existing sessions are saved at the end of the request:
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(c)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	eq(2, st.Get(id).Attr("a"))
+}
+
+// testVersionedStore increments the "count" attribute of the session with the given id
+// concurrently using UpdateInStore(), and checks that no increments are lost.
+// It is the same as the one in the tests of package session.
+func testVersionedStore(t *testing.T, st session.StoreCtx, id string) {
+	eq := mighty.Eq(t)
+
+	const workers, increments = 4, 5
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for {
+					_, err := session.UpdateInStore(ctx, st, id, func(attrs map[string]interface{}) {
+						attrs["count"] = attrs["count"].(int) + 1
+					})
+					if err == nil {
+						break
+					}
+					if err != session.ErrVersionConflict {
+						t.Error("Unexpected error:", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sess, err := st.GetCtx(ctx, id)
+	eq(nil, err)
+	eq(workers*increments, sess.Attr("count"))
+}
+
+// testSaver checks the Saver implementation of st.
+// It is the same as the one in the tests of package session.
+func testSaver(t *testing.T, st session.Store) {
+	eq, neq := mighty.EqNeq(t)
+	ctx := context.Background()
+	sv := st.(session.Saver)
+
+	s := session.NewSessionOptions(&session.SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	eq(0, len(s.DirtyAttrs()))
+
+	// Clean session: only the access is recorded
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(nil, sv.Save(ctx, s2))
+	eq(1, st.Get(s.ID()).Attr("a"))
+
+	// Dirty session is saved:
+	s2.SetAttr("b", 2)
+	eq(true, reflect.DeepEqual([]string{"b"}, s2.DirtyAttrs()))
+	eq(nil, sv.Save(ctx, s2))
+	eq(0, len(s2.DirtyAttrs()))
+	s3 := st.Get(s.ID())
+	eq(2, s3.Attr("b"))
+	eq(false, s3.Modified().IsZero())
+
+	// Removed sessions must not be resurrected:
+	st.Remove(s3)
+	s3.SetAttr("c", 3)
+	eq(nil, sv.Save(ctx, s3))
+	eq(nil, st.Get(s.ID()))
+}
@@ -1,11 +1,18 @@
 /*
 
-Session Store interface.
+Session Store interfaces.
 
 */
 
 package session
 
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+)
+
 // Store is a session store interface.
 // A session store is responsible to store sessions and make them retrievable by their IDs at the server side.
 type Store interface {
@@ -23,3 +30,195 @@ type Store interface {
 	// Close closes the session store, releasing any resources that were allocated.
 	Close()
 }
+
+// StoreCtx is a context-aware session store interface whose operations report failures.
+// It is the counterpart of Store for stores whose operations may fail (e.g. networked or disk-backed stores).
+//
+// NewStoreCtxAdapter() and NewStoreAdapter() can be used to convert between Store and StoreCtx.
+type StoreCtx interface {
+	// GetCtx returns the session specified by its id.
+	// The returned session will have an updated access time (set to the current time).
+	// nil session and nil error is returned if this store does not contain a session with the specified id.
+	GetCtx(ctx context.Context, id string) (Session, error)
+
+	// AddCtx adds a new session to the store.
+	AddCtx(ctx context.Context, sess Session) error
+
+	// RemoveCtx removes a session from the store.
+	RemoveCtx(ctx context.Context, sess Session) error
+
+	// Close closes the session store, releasing any resources that were allocated.
+	Close()
+}
+
+// ErrSessionNotFound is returned by Regenerator.Regenerate() if the session is not in the store
+// (e.g. it has been removed or it has expired), so its ID cannot be regenerated.
+var ErrSessionNotFound = errors.New("session: session not found")
+
+// Regenerator is an optional interface that may be implemented by Store and StoreCtx implementations
+// to support changing the ID of sessions atomically (e.g. to prevent session fixation after login).
+//
+// Stores not implementing this interface are handled by adding the new session and then removing
+// the old one, which is not atomic.
+type Regenerator interface {
+	// Regenerate replaces sess with a new session having a new ID, created by regenerating
+	// the ID of sess: the new session keeps the creation time and the attributes of sess.
+	// The new session is stored, sess is removed from the store so its ID is invalidated.
+	// If sess is not in the store (e.g. it has been removed or it has expired), ErrSessionNotFound is returned
+	// and nothing is stored, so revoked sessions cannot be revived.
+	Regenerate(ctx context.Context, sess Session) (Session, error)
+}
+
+// regenerate regenerates the ID of sess in st, using Regenerator if st implements it.
+func regenerate(ctx context.Context, st StoreCtx, sess Session) (Session, error) {
+	if r, ok := st.(Regenerator); ok {
+		return r.Regenerate(ctx, sess)
+	}
+
+	if cur, err := st.GetCtx(ctx, sess.ID()); err != nil {
+		return nil, err
+	} else if cur == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.AddCtx(ctx, sess2); err != nil {
+		return nil, err
+	}
+	if err := st.RemoveCtx(ctx, sess); err != nil {
+		st.RemoveCtx(ctx, sess2)
+		return nil, err
+	}
+	return sess2, nil
+}
+
+// Saver is an optional interface that may be implemented by Store and StoreCtx implementations
+// which do not persist changes of sessions automatically (e.g. stores which decode sessions on each access).
+// Managers implementing it (e.g. CookieManager) delegate to their store, and the Middleware
+// calls it at the end of each request.
+type Saver interface {
+	// Save persists the session at the end of a request, if it is needed:
+	// if the session is dirty (see Session.DirtyAttrs()), it is saved and marked saved,
+	// else only its last accessed time is updated, if the store keeps track of it.
+	// Sessions not in the store (e.g. removed or expired ones) are not added again.
+	Save(ctx context.Context, sess Session) error
+}
+
+// save saves sess in st if st implements Saver.
+func save(ctx context.Context, st StoreCtx, sess Session) error {
+	if sv, ok := st.(Saver); ok {
+		return sv.Save(ctx, sess)
+	}
+	return nil
+}
+
+// ErrNotIndexed is returned by IndexedStore methods if the store has no index configured.
+var ErrNotIndexed = errors.New("session: store is not indexed")
+
+// IndexedStore is an optional interface that may be implemented by Store and StoreCtx implementations
+// which maintain a secondary index of sessions by the value of a constant attribute (e.g. "UserName"),
+// so all sessions of a user can be listed or removed (e.g. to log out the user everywhere).
+// See InMemStoreOptions.IndexCAttr.
+//
+// Only sessions having a comparable (see reflect.Value.Comparable()), non-nil value for the indexed
+// constant attribute are indexed.
+type IndexedStore interface {
+	// IndexCAttr returns the name of the constant attribute sessions are indexed by,
+	// empty string if the store has no index configured.
+	IndexCAttr() string
+
+	// IndexedSessions returns the unexpired sessions whose indexed constant attribute has the given value,
+	// in the order of their creation.
+	IndexedSessions(ctx context.Context, value interface{}) ([]Session, error)
+
+	// RemoveIndexed removes all sessions whose indexed constant attribute has the given value,
+	// and returns the number of removed sessions.
+	RemoveIndexed(ctx context.Context, value interface{}) (int, error)
+}
+
+// indexable tells if v can be used as a key of an index.
+func indexable(v interface{}) bool {
+	return v != nil && reflect.ValueOf(v).Comparable()
+}
+
+// SnapshotStore is an optional interface that may be implemented by Store and StoreCtx implementations
+// which keep sessions in memory only (e.g. the in-memory store), so sessions can survive restarts.
+// See InMemStoreOptions.SnapshotFile.
+type SnapshotStore interface {
+	// Snapshot writes all unexpired sessions of the store to w.
+	Snapshot(w io.Writer) error
+
+	// Restore adds the sessions of a snapshot written by Snapshot() to the store.
+	// Sessions that have expired since the snapshot was taken are not added, they are reported
+	// as expired. Nothing is added if the snapshot cannot be read entirely.
+	Restore(r io.Reader) error
+}
+
+// dirty tells if sess has been modified since it was last saved.
+func dirty(sess Session) bool {
+	return len(sess.DirtyAttrs()) > 0
+}
+
+// ErrVersionConflict is returned by VersionedStore.SaveIfVersion() if the stored session
+// was modified concurrently (or it no longer exists).
+var ErrVersionConflict = errors.New("session: version conflict")
+
+// VersionedStore is an optional interface that may be implemented by StoreCtx implementations
+// to support optimistic concurrency control based on Session.Version().
+//
+// Stores sharing Session values between requests (e.g. the in-memory store) need not implement it:
+// Session.Update() and Session.CompareAndSwapAttr() are atomic on shared values.
+// Stores returning a new Session value on each access (e.g. stores which decode sessions)
+// should implement it, else concurrent modifications may overwrite each other.
+type VersionedStore interface {
+	// SaveIfVersion saves sess only if the version of the stored session equals version
+	// (which is usually the version sess had when it was loaded from the store).
+	// ErrVersionConflict is returned if the stored session has a different version or it does not exist.
+	SaveIfVersion(ctx context.Context, sess Session, version uint64) error
+}
+
+// maxUpdateAttempts is the max number of attempts UpdateInStore() makes on version conflicts.
+const maxUpdateAttempts = 10
+
+// UpdateInStore atomically modifies the attributes of the session with the given id stored in st:
+// it loads the session, calls Session.Update() with f, and saves the session.
+// The modified session is returned, nil session and nil error is returned if st does not contain
+// a session with the given id.
+//
+// If st implements VersionedStore, the session is only saved if it was not modified concurrently,
+// else the whole operation is retried (so f may be called multiple times).
+// ErrVersionConflict is returned if the session could not be saved after several attempts.
+// Stores not implementing VersionedStore are handled by adding the modified session again (StoreCtx.AddCtx()).
+func UpdateInStore(ctx context.Context, st StoreCtx, id string, f func(attrs map[string]interface{})) (Session, error) {
+	vs, versioned := st.(VersionedStore)
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		sess, err := st.GetCtx(ctx, id)
+		if sess == nil || err != nil {
+			return nil, err
+		}
+
+		version := sess.Version()
+		sess.Update(f)
+
+		if !versioned {
+			if err := st.AddCtx(ctx, sess); err != nil {
+				return nil, err
+			}
+			return sess, nil
+		}
+		switch err := vs.SaveIfVersion(ctx, sess, version); err {
+		case nil:
+			return sess, nil
+		case ErrVersionConflict:
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, ErrVersionConflict
+}
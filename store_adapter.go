@@ -0,0 +1,158 @@
+/*
+
+Adapters between the Store and StoreCtx interfaces.
+
+*/
+
+package session
+
+import (
+	"context"
+	"log"
+	"log/slog"
+)
+
+// storeCtxAdapter adapts a Store to StoreCtx.
+type storeCtxAdapter struct {
+	Store
+}
+
+// NewStoreCtxAdapter returns a StoreCtx backed by the given Store.
+// Since Store operations cannot report failures, the returned StoreCtx never returns errors,
+// and the contexts are ignored.
+// If st was returned by NewStoreAdapter(), the adapted StoreCtx is returned.
+// If st already implements StoreCtx, it is returned as-is.
+func NewStoreCtxAdapter(st Store) StoreCtx {
+	if a, ok := st.(storeAdapter); ok {
+		return a.StoreCtx
+	}
+	if sc, ok := st.(StoreCtx); ok {
+		return sc
+	}
+	return storeCtxAdapter{st}
+}
+
+// GetCtx is to implement StoreCtx.GetCtx().
+func (a storeCtxAdapter) GetCtx(ctx context.Context, id string) (Session, error) {
+	return a.Get(id), nil
+}
+
+// AddCtx is to implement StoreCtx.AddCtx().
+func (a storeCtxAdapter) AddCtx(ctx context.Context, sess Session) error {
+	a.Add(sess)
+	return nil
+}
+
+// RemoveCtx is to implement StoreCtx.RemoveCtx().
+func (a storeCtxAdapter) RemoveCtx(ctx context.Context, sess Session) error {
+	a.Remove(sess)
+	return nil
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+// It uses the adapted Store if it implements Regenerator.
+func (a storeCtxAdapter) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	if r, ok := a.Store.(Regenerator); ok {
+		return r.Regenerate(ctx, sess)
+	}
+
+	if a.Get(sess.ID()) == nil {
+		return nil, ErrSessionNotFound
+	}
+	sess2, err := regenerateID(sess)
+	if err != nil {
+		return nil, err
+	}
+	a.Add(sess2)
+	a.Remove(sess)
+	return sess2, nil
+}
+
+// Save is to implement Saver.Save().
+// It uses the adapted Store if it implements Saver.
+func (a storeCtxAdapter) Save(ctx context.Context, sess Session) error {
+	if sv, ok := a.Store.(Saver); ok {
+		return sv.Save(ctx, sess)
+	}
+	return nil
+}
+
+// storeAdapter adapts a StoreCtx to Store.
+type storeAdapter struct {
+	StoreCtx
+	logger *sessLogger // Logger of errors
+}
+
+// StoreAdapterOptions defines options that may be passed when creating a new Store adapter.
+// All fields are optional; default value will be used for any field that has the zero value.
+type StoreAdapterOptions struct {
+	// Logger to log errors of the adapted StoreCtx with.
+	// Default is to use the global functions of the log package.
+	// To disable logging, you may use NoopLogger.
+	Logger *log.Logger
+
+	// Handler to emit structured log records of errors with (see LogEvent), default is none.
+	// If set, Logger is not used.
+	LogHandler slog.Handler
+
+	// Levels of structured log records by event, overriding the default levels listed at LogEvent.
+	LogLevels map[LogEvent]slog.Level
+}
+
+// Pointer to zero value of StoreAdapterOptions to be reused for efficiency.
+var zeroStoreAdapterOptions = new(StoreAdapterOptions)
+
+// NewStoreAdapter returns a Store backed by the given StoreCtx with the default options.
+// Default values of options are listed in the StoreAdapterOptions type.
+// See NewStoreAdapterOptions() for details.
+func NewStoreAdapter(st StoreCtx) Store {
+	return NewStoreAdapterOptions(st, zeroStoreAdapterOptions)
+}
+
+// NewStoreAdapterOptions returns a Store backed by the given StoreCtx with the specified options.
+// Operations are called with context.Background(), errors are logged.
+// If st was returned by NewStoreCtxAdapter(), the adapted Store is returned.
+// If st already implements Store, it is returned as-is.
+func NewStoreAdapterOptions(st StoreCtx, o *StoreAdapterOptions) Store {
+	if a, ok := st.(storeCtxAdapter); ok {
+		return a.Store
+	}
+	if s, ok := st.(Store); ok {
+		return s
+	}
+	return storeAdapter{StoreCtx: st, logger: newSessLogger(o.Logger, o.LogHandler, o.LogLevels)}
+}
+
+// Get is to implement Store.Get().
+func (a storeAdapter) Get(id string) Session {
+	sess, err := a.GetCtx(context.Background(), id)
+	if err != nil {
+		a.logger.error("Failed to get session", err, id)
+		return nil
+	}
+	return sess
+}
+
+// Add is to implement Store.Add().
+func (a storeAdapter) Add(sess Session) {
+	if err := a.AddCtx(context.Background(), sess); err != nil {
+		a.logger.error("Failed to add session", err, sess.ID())
+	}
+}
+
+// Remove is to implement Store.Remove().
+func (a storeAdapter) Remove(sess Session) {
+	if err := a.RemoveCtx(context.Background(), sess); err != nil {
+		a.logger.error("Failed to remove session", err, sess.ID())
+	}
+}
+
+// Regenerate is to implement Regenerator.Regenerate().
+func (a storeAdapter) Regenerate(ctx context.Context, sess Session) (Session, error) {
+	return regenerate(ctx, a.StoreCtx, sess)
+}
+
+// Save is to implement Saver.Save().
+func (a storeAdapter) Save(ctx context.Context, sess Session) error {
+	return save(ctx, a.StoreCtx, sess)
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/icza/mighty"
+)
+
+// errStore is a StoreCtx whose operations always fail.
+type errStore struct{}
+
+var errTestStore = errors.New("test store failure")
+
+func (errStore) GetCtx(ctx context.Context, id string) (Session, error) { return nil, errTestStore }
+func (errStore) AddCtx(ctx context.Context, sess Session) error         { return errTestStore }
+func (errStore) RemoveCtx(ctx context.Context, sess Session) error      { return errTestStore }
+func (errStore) Close()                                                 {}
+
+func TestStoreCtxAdapter(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	sc := NewStoreCtxAdapter(st)
+	ctx := context.Background()
+
+	s := NewSession()
+	eq(nil, sc.AddCtx(ctx, s))
+	got, err := sc.GetCtx(ctx, s.ID())
+	eq(nil, err)
+	eq(s, got)
+	eq(nil, sc.RemoveCtx(ctx, s))
+	got, err = sc.GetCtx(ctx, s.ID())
+	eq(nil, err)
+	eq(nil, got)
+
+	// Adapting back must unwrap:
+	eq(st, NewStoreAdapter(sc))
+}
+
+func TestStoreAdapter(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	sc := StoreCtx(errStore{})
+	st := NewStoreAdapterOptions(sc, &StoreAdapterOptions{Logger: NoopLogger})
+
+	s := NewSession()
+	st.Add(s)
+	eq(nil, st.Get(s.ID()))
+	st.Remove(s)
+
+	// Adapting back must unwrap:
+	eq(sc, NewStoreCtxAdapter(st))
+}
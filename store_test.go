@@ -0,0 +1,139 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icza/mighty"
+)
+
+// testVersionedStore increments the "count" attribute of the session with the given id
+// concurrently using UpdateInStore(), and checks that no increments are lost.
+func testVersionedStore(t *testing.T, st StoreCtx, id string) {
+	eq := mighty.Eq(t)
+
+	const workers, increments = 4, 5
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for {
+					_, err := UpdateInStore(ctx, st, id, func(attrs map[string]interface{}) {
+						attrs["count"] = attrs["count"].(int) + 1
+					})
+					if err == nil {
+						break
+					}
+					if err != ErrVersionConflict {
+						t.Error("Unexpected error:", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	sess, err := st.GetCtx(ctx, id)
+	eq(nil, err)
+	eq(workers*increments, sess.Attr("count"))
+}
+
+// testSaver checks the Saver implementation of st.
+func testSaver(t *testing.T, st Store) {
+	eq, neq := mighty.EqNeq(t)
+	ctx := context.Background()
+	sv := st.(Saver)
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"a": 1}})
+	st.Add(s)
+	eq(0, len(s.DirtyAttrs()))
+
+	// Clean session: only the access is recorded
+	s2 := st.Get(s.ID())
+	neq(nil, s2)
+	eq(nil, sv.Save(ctx, s2))
+	eq(1, st.Get(s.ID()).Attr("a"))
+
+	// Dirty session is saved:
+	s2.SetAttr("b", 2)
+	eq(true, reflect.DeepEqual([]string{"b"}, s2.DirtyAttrs()))
+	eq(nil, sv.Save(ctx, s2))
+	eq(0, len(s2.DirtyAttrs()))
+	s3 := st.Get(s.ID())
+	eq(2, s3.Attr("b"))
+	eq(false, s3.Modified().IsZero())
+
+	// Removed sessions must not be resurrected:
+	st.Remove(s3)
+	s3.SetAttr("c", 3)
+	eq(nil, sv.Save(ctx, s3))
+	eq(nil, st.Get(s.ID()))
+}
+
+// testRegenerateRevoked checks that sessions not in st (removed or expired ones) cannot be regenerated.
+func testRegenerateRevoked(t *testing.T, st Store) {
+	eq, neq := mighty.EqNeq(t)
+	ctx := context.Background()
+	sc := NewStoreCtxAdapter(st)
+
+	s := NewSession()
+	st.Add(s)
+	st.Remove(s)
+	s2, err := regenerate(ctx, sc, s)
+	eq(ErrSessionNotFound, err)
+	eq(nil, s2)
+
+	short := NewSessionOptions(&SessOptions{Timeout: 20 * time.Millisecond})
+	st.Add(short)
+	time.Sleep(40 * time.Millisecond)
+	s2, err = regenerate(ctx, sc, short)
+	eq(ErrSessionNotFound, err)
+	eq(nil, s2)
+
+	s = NewSession()
+	st.Add(s)
+	s2, err = regenerate(ctx, sc, s)
+	eq(nil, err)
+	eq(nil, st.Get(s.ID()))
+	neq(nil, st.Get(s2.ID()))
+}
+
+// plainStore hides the optional interfaces of the wrapped Store.
+type plainStore struct {
+	Store
+}
+
+func TestRegenerateRevoked(t *testing.T) {
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	testRegenerateRevoked(t, plainStore{st}) // Not atomic, without Regenerator
+}
+
+func TestUpdateInStore(t *testing.T) {
+	eq := mighty.Eq(t)
+
+	st := NewInMemStoreOptions(&InMemStoreOptions{Logger: NoopLogger})
+	defer st.Close()
+
+	s := NewSessionOptions(&SessOptions{Attrs: map[string]interface{}{"count": 0}})
+	st.Add(s)
+
+	testVersionedStore(t, NewStoreCtxAdapter(st), s.ID())
+	eq(20, s.Attr("count"))
+
+	sess, err := UpdateInStore(context.Background(), NewStoreCtxAdapter(st), "asdf", nil)
+	eq(nil, sess)
+	eq(nil, err)
+
+	_, err = UpdateInStore(context.Background(), errStore{}, s.ID(), nil)
+	eq(errTestStore, err)
+}